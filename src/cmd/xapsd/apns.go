@@ -0,0 +1,257 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+//
+// Create an APNS client for the given certificate. Connections to
+// Apple go through the HTTP CONNECT proxy configured in
+// Config.APNS.Proxy. Without a configured proxy the usual
+// HTTPS_PROXY and NO_PROXY environment variables are honored.
+//
+
+func newAPNSClient(cert tls.Certificate) (*apns2.Client, error) {
+	proxy, err := apnsProxy()
+	if err != nil {
+		return nil, err
+	}
+
+	client := apns2.NewClient(cert).Production()
+	client.HTTPClient.Transport = &http.Transport{
+		Proxy:               proxy,
+		TLSClientConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     5 * time.Minute,
+	}
+
+	return client, nil
+}
+
+func apnsProxy() (func(*http.Request) (*url.URL, error), error) {
+	if Config.APNS.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxy := Config.APNS.Proxy
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid APNS proxy '%s': %v", Config.APNS.Proxy, err)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("Invalid APNS proxy '%s': no host", Config.APNS.Proxy)
+	}
+
+	if Config.APNS.ProxyUser != "" {
+		proxyURL.User = url.UserPassword(Config.APNS.ProxyUser, Config.APNS.ProxyPassword)
+	}
+
+	if *debug {
+		log.Println("[DEBUG] Using APNS proxy", proxyURL.Redacted())
+	}
+
+	return http.ProxyURL(proxyURL), nil
+}
+
+const defaultSubtopic = "com.apple.mobilemail"
+
+//
+// A push identity is a certificate and the APNS topic it was issued
+// for, together with the aps-subtopics that devices register with.
+// Mail, calendar and contacts push each use their own identity.
+//
+
+type pushIdentity struct {
+	name        string
+	certificate string
+	topic       string
+	subtopics   []string
+
+	// The certificate can be replaced while xapsd is running, so
+	// these are guarded by mu.
+	mu           sync.RWMutex
+	client       *apns2.Client
+	leaf         *x509.Certificate
+	modTime      time.Time
+	expiryWarned int
+}
+
+type pushIdentities struct {
+	all        []*pushIdentity
+	bySubtopic map[string]*pushIdentity
+}
+
+//
+// Load all configured push identities. Without any [Identities]
+// in the configuration there is a single mail identity that uses
+// Config.Certificate.
+//
+
+func loadIdentities() (*pushIdentities, error) {
+	configs := Config.Identities
+	if len(configs) == 0 {
+		configs = map[string]IdentityConfig{
+			"mail": {Certificate: Config.Certificate, Subtopics: []string{defaultSubtopic}},
+		}
+	}
+
+	identities := &pushIdentities{bySubtopic: make(map[string]*pushIdentity)}
+	for name, config := range configs {
+		if len(config.Subtopics) == 0 {
+			return nil, fmt.Errorf("Identity '%s' has no subtopics", name)
+		}
+
+		identity, err := loadIdentity(name, config)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, subtopic := range config.Subtopics {
+			if other, ok := identities.bySubtopic[subtopic]; ok {
+				return nil, fmt.Errorf("Subtopic '%s' is used by both identity '%s' and '%s'", subtopic, other.name, name)
+			}
+			identities.bySubtopic[subtopic] = identity
+		}
+		identities.all = append(identities.all, identity)
+	}
+
+	return identities, nil
+}
+
+func loadIdentity(name string, config IdentityConfig) (*pushIdentity, error) {
+	if config.Certificate == "" {
+		return nil, fmt.Errorf("Identity '%s' has no certificate", name)
+	}
+
+	identity := &pushIdentity{name: name, certificate: config.Certificate, subtopics: config.Subtopics, expiryWarned: -1}
+
+	loaded, err := identity.load()
+	if err != nil {
+		return nil, err
+	}
+
+	identity.topic = loaded.topic
+	identity.client = loaded.client
+	identity.leaf = loaded.leaf
+	identity.modTime = loaded.modTime
+
+	return identity, nil
+}
+
+type loadedCertificate struct {
+	topic   string
+	client  *apns2.Client
+	leaf    *x509.Certificate
+	modTime time.Time
+}
+
+//
+// Load and validate the certificate of the identity and create an
+// APNS client for it. This does not modify the identity.
+//
+
+func (identity *pushIdentity) load() (*loadedCertificate, error) {
+	if *debug {
+		log.Println("[DEBUG] Parsing", identity.certificate, "to obtain APNS Topic for identity", identity.name)
+	}
+
+	info, err := os.Stat(identity.certificate)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load certificate for identity '%s': %v", identity.name, err)
+	}
+
+	cert, err := loadCertificate(identity.certificate)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load certificate for identity '%s': %v", identity.name, err)
+	}
+	if cert.Leaf == nil {
+		return nil, fmt.Errorf("Could not load certificate for identity '%s': no certificate found", identity.name)
+	}
+
+	if time.Now().After(cert.Leaf.NotAfter) {
+		if !Config.APNS.AllowExpiredCertificate {
+			return nil, fmt.Errorf("Certificate for identity '%s' has expired on %s", identity.name, cert.Leaf.NotAfter.Format(time.RFC1123))
+		}
+		log.Printf("Using expired certificate for identity %s because AllowExpiredCertificate is set", identity.name)
+	}
+
+	topic, err := topicFromCertificate(cert.Leaf)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse apns topic from certificate for identity '%s': %v", identity.name, err)
+	}
+
+	if *debug {
+		log.Println("[DEBUG] Topic for identity", identity.name, "is", topic)
+		log.Println("[DEBUG] Creating APNS client to", apns2.HostProduction)
+	}
+
+	client, err := newAPNSClient(cert)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create APNS client for identity '%s': %v", identity.name, err)
+	}
+
+	return &loadedCertificate{topic: topic, client: client, leaf: cert.Leaf, modTime: info.ModTime()}, nil
+}
+
+func (identity *pushIdentity) current() (*apns2.Client, *x509.Certificate) {
+	identity.mu.RLock()
+	defer identity.mu.RUnlock()
+	return identity.client, identity.leaf
+}
+
+//
+// Find the identity for a subtopic. Registrations that were stored
+// without a subtopic belong to the mail identity.
+//
+
+func (identities *pushIdentities) forSubtopic(subtopic string) (*pushIdentity, error) {
+	if subtopic == "" {
+		subtopic = defaultSubtopic
+	}
+	identity, ok := identities.bySubtopic[subtopic]
+	if !ok {
+		return nil, errors.New("Unknown aps-subtopic")
+	}
+	return identity, nil
+}
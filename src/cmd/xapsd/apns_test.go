@@ -0,0 +1,100 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_apnsProxy(t *testing.T) {
+	defer func(proxy, user, password string) {
+		Config.APNS.Proxy, Config.APNS.ProxyUser, Config.APNS.ProxyPassword = proxy, user, password
+	}(Config.APNS.Proxy, Config.APNS.ProxyUser, Config.APNS.ProxyPassword)
+
+	req, _ := http.NewRequest("GET", "https://api.push.apple.com/3/device/x", nil)
+
+	if true {
+		Config.APNS.Proxy = "proxy.example.com:3128"
+		Config.APNS.ProxyUser = ""
+
+		proxy, err := apnsProxy()
+		if err != nil {
+			t.Fatal("Cannot apnsProxy:", err)
+		}
+
+		u, _ := proxy(req)
+		if u == nil || u.String() != "http://proxy.example.com:3128" {
+			t.Error(`u != "http://proxy.example.com:3128"`, u)
+		}
+	}
+
+	if true {
+		Config.APNS.Proxy = "http://proxy.example.com:3128"
+		Config.APNS.ProxyUser = "xapsd"
+		Config.APNS.ProxyPassword = "p@ss"
+
+		proxy, err := apnsProxy()
+		if err != nil {
+			t.Fatal("Cannot apnsProxy:", err)
+		}
+
+		u, _ := proxy(req)
+		if password, _ := u.User.Password(); u.User.Username() != "xapsd" || password != "p@ss" {
+			t.Error("Proxy credentials not applied", u)
+		}
+	}
+
+	if true {
+		Config.APNS.Proxy = "http://"
+		if _, err := apnsProxy(); err == nil {
+			t.Error(`apnsProxy() accepted "http://"`)
+		}
+	}
+}
+
+func Test_pushIdentities_forSubtopic(t *testing.T) {
+	mail := &pushIdentity{name: "mail", topic: "com.apple.mail.XServer.1"}
+	calendar := &pushIdentity{name: "calendar", topic: "com.apple.calendar.XServer.1"}
+	identities := &pushIdentities{
+		all: []*pushIdentity{mail, calendar},
+		bySubtopic: map[string]*pushIdentity{
+			"com.apple.mobilemail": mail,
+			"com.apple.calendar":   calendar,
+		},
+	}
+
+	if identity, err := identities.forSubtopic("com.apple.calendar"); err != nil || identity != calendar {
+		t.Error(`forSubtopic("com.apple.calendar") != calendar`)
+	}
+
+	if identity, err := identities.forSubtopic(""); err != nil || identity != mail {
+		t.Error(`forSubtopic("") != mail`)
+	}
+
+	if _, err := identities.forSubtopic("com.example.unknown"); err == nil {
+		t.Error(`forSubtopic("com.example.unknown") did not fail`)
+	}
+}
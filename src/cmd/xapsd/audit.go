@@ -0,0 +1,264 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// The audit trail records what happened to registrations, so that it
+// is possible to find out why a device stopped getting notifications.
+// Events are appended to Config.Audit.File as JSON, one per line. Only
+// the start of the device token and account id is recorded, which is
+// enough to tell devices apart but not to send them pushes, and keeps
+// the values that encryption protects out of the file.
+//
+
+const (
+	auditRegistered       = "registered"
+	auditMailboxesChanged = "mailboxes-changed"
+	auditRemoved          = "removed"
+	auditExpired          = "expired"
+	auditRemovedByAdmin   = "removed-by-admin"
+)
+
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Username  string    `json:"username"`
+	AccountId string    `json:"account-id"`
+	Device    string    `json:"device"`
+	Subtopic  string    `json:"subtopic,omitempty"`
+	Mailboxes []string  `json:"mailboxes,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+var auditMutex sync.Mutex
+
+func recordAudit(event string, reg Registration, reason string) {
+	if Config.Audit.File == "" {
+		return
+	}
+
+	line, err := json.Marshal(auditRecord{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		Username:  reg.Username,
+		AccountId: auditPrefix(reg.AccountId),
+		Device:    auditPrefix(reg.DeviceToken),
+		Subtopic:  reg.Subtopic,
+		Mailboxes: reg.Mailboxes,
+		Reason:    reason,
+	})
+	if err != nil {
+		log.Println("Cannot write audit record: ", err)
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	// Each record is a single write to a file opened for appending, so
+	// that records from xapsd and its subcommands do not mix
+	f, err := os.OpenFile(Config.Audit.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Println("Cannot write audit record: ", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Println("Cannot write audit record: ", err)
+	}
+}
+
+func auditPrefix(value string) string {
+	if len(value) > 8 {
+		return value[:8]
+	}
+	return value
+}
+
+//
+// An auditingStore records new registrations and changed mailboxes.
+// The store it wraps reports the registration that a REGISTER
+// replaced, so nothing has to be looked up.
+//
+
+type auditingStore struct {
+	registeringStore
+}
+
+func (s *auditingStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	reg := Registration{Username: username, AccountId: accountId, DeviceToken: deviceToken, Subtopic: subtopic, Mailboxes: mailboxes}
+	previous, err := s.register(reg)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case previous == nil:
+		recordAudit(auditRegistered, reg, "")
+	case !sameMailboxes(previous.Mailboxes, mailboxes):
+		recordAudit(auditMailboxesChanged, reg, "was "+strings.Join(previous.Mailboxes, ", "))
+	}
+
+	return nil
+}
+
+func (s *auditingStore) ping() error {
+	if p, ok := s.registeringStore.(pinger); ok {
+		return p.ping()
+	}
+	return nil
+}
+
+func sameMailboxes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func readAuditTrail(path, username string) ([]auditRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("Invalid audit record on line %d: %v", line, err)
+		}
+		if record.Username == username {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+func runAudit(config string, args []string) error {
+	if len(args) != 1 {
+		return usageError("audit username")
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+	if Config.Audit.File == "" {
+		return fmt.Errorf("There is no audit File in the configuration")
+	}
+
+	normalizer, err := newUsernameNormalizer()
+	if err != nil {
+		return err
+	}
+	username := normalizer.normalize(args[0])
+
+	records, err := readAuditTrail(Config.Audit.File, username)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		details := strings.Join(record.Mailboxes, ", ")
+		if record.Reason != "" {
+			details += " (" + record.Reason + ")"
+		}
+		fmt.Printf("%s  %-17s  %s  %s  %s\n", record.Time.Format(time.RFC3339), record.Event, record.AccountId, record.Device, details)
+	}
+	if len(records) == 0 {
+		fmt.Printf("No events for %s\n", username)
+	}
+	return nil
+}
+
+//
+// Remove the registrations of a user, or of one account of a user.
+//
+
+func runRemove(config string, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usageError("remove username [account-id]")
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+
+	normalizer, err := newUsernameNormalizer()
+	if err != nil {
+		return err
+	}
+	username := normalizer.normalize(args[0])
+
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, reg := range registrations {
+		if reg.Username != username || (len(args) == 2 && reg.AccountId != args[1]) {
+			continue
+		}
+		if err := db.deleteRegistration(reg); err != nil {
+			return fmt.Errorf("Removed %d registrations, cannot remove %s/%s: %v", removed, reg.Username, reg.AccountId, err)
+		}
+		recordAudit(auditRemovedByAdmin, reg, "")
+		removed++
+	}
+
+	fmt.Printf("Removed %d registrations\n", removed)
+	return nil
+}
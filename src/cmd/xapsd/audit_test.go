@@ -0,0 +1,147 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_auditingStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(file string) { Config.Audit.File = file }(Config.Audit.File)
+	Config.Audit.File = filepath.Join(dir, "audit.log")
+
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	store := &auditingStore{db}
+	register := func(username, accountId, deviceToken string, mailboxes ...string) {
+		if err := store.addRegistration(username, accountId, deviceToken, "com.apple.mobilemail", mailboxes); err != nil {
+			t.Fatal("Cannot addRegistration:", err)
+		}
+	}
+	register("test@example.com", "testaccountid", "0123456789abcdef", "Inbox")
+	register("test@example.com", "testaccountid", "0123456789abcdef", "Inbox")
+	register("test@example.com", "testaccountid", "0123456789abcdef", "Inbox", "Notes")
+	register("other@example.com", "otheraccountid", "fedcba9876543210", "Inbox")
+
+	registrations, err := store.findRegistrations("test@example.com", "Inbox")
+	if err != nil {
+		t.Fatal("Cannot findRegistrations:", err)
+	}
+	for _, reg := range registrations {
+		if err := store.deleteRegistration(reg); err != nil {
+			t.Fatal("Cannot deleteRegistration:", err)
+		}
+		recordAudit(auditRemoved, reg, "APNs 410 Unregistered")
+	}
+
+	records, err := readAuditTrail(Config.Audit.File, "test@example.com")
+	if err != nil {
+		t.Fatal("Cannot read audit trail:", err)
+	}
+
+	events := []string{auditRegistered, auditMailboxesChanged, auditRemoved}
+	if len(records) != len(events) {
+		t.Fatal("Unexpected audit records", records)
+	}
+	for i, event := range events {
+		if records[i].Event != event {
+			t.Errorf("Event %d is %s instead of %s", i, records[i].Event, event)
+		}
+	}
+	if records[1].Reason != "was Inbox" || len(records[1].Mailboxes) != 2 {
+		t.Error("Unexpected mailboxes-changed record", records[1])
+	}
+	if records[2].Device != "01234567" || records[2].AccountId != "testacco" || records[2].Reason != "APNs 410 Unregistered" {
+		t.Error("Unexpected removed record", records[2])
+	}
+}
+
+//
+// With encryption the driver only sees lookup hashes, and a plaintext
+// registration from before encryption is replaced, not new.
+//
+
+func Test_auditingStore_Encrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(file string) { Config.Audit.File = file }(Config.Audit.File)
+	Config.Audit.File = filepath.Join(dir, "audit.log")
+
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	if err := db.addRegistration("test@example.com", "testaccountid", "0123456789abcdef", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+
+	store := &auditingStore{&encryptingStore{db, newTestCipher(t)}}
+	for _, mailboxes := range [][]string{{"Inbox"}, {"Inbox"}, {"Inbox", "Notes"}} {
+		if err := store.addRegistration("test@example.com", "testaccountid", "0123456789abcdef", "com.apple.mobilemail", mailboxes); err != nil {
+			t.Fatal("Cannot addRegistration:", err)
+		}
+	}
+
+	records, err := readAuditTrail(Config.Audit.File, "test@example.com")
+	if err != nil {
+		t.Fatal("Cannot read audit trail:", err)
+	}
+	if len(records) != 1 || records[0].Event != auditMailboxesChanged || records[0].Device != "01234567" || records[0].AccountId != "testacco" {
+		t.Error("Unexpected audit records", records)
+	}
+}
+
+func Test_recordAudit_Disabled(t *testing.T) {
+	defer func(file string) { Config.Audit.File = file }(Config.Audit.File)
+	Config.Audit.File = ""
+
+	// Does nothing without a file
+	recordAudit(auditRegistered, Registration{Username: "test@example.com"}, "")
+}
+
+func Test_sameMailboxes(t *testing.T) {
+	if !sameMailboxes([]string{"Inbox", "Notes"}, []string{"Notes", "Inbox"}) {
+		t.Error("sameMailboxes is not true for the same mailboxes in another order")
+	}
+	if sameMailboxes([]string{"Inbox", "Notes"}, []string{"Inbox", "Ham"}) {
+		t.Error("sameMailboxes is true for different mailboxes")
+	}
+	if sameMailboxes([]string{"Inbox"}, []string{"Inbox", "Inbox"}) {
+		t.Error("sameMailboxes is true for lists of different length")
+	}
+}
@@ -0,0 +1,189 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+//
+// A cachingStore remembers the result of findRegistrations for a
+// while, so that a burst of mail for a user does not run the same
+// query for every message. Every change to the registrations of a user
+// forgets what was cached for that user. Results are only cached if
+// nothing was forgotten while they were looked up, so a lookup that
+// races with a REGISTER never caches the old registrations.
+//
+
+type cachingStore struct {
+	registrationStore
+	ttl  time.Duration
+	size int
+
+	mu         sync.Mutex
+	entries    map[cacheKey]*list.Element
+	users      map[string]map[string]*list.Element
+	lru        *list.List
+	generation uint64
+}
+
+type cacheKey struct {
+	username string
+	mailbox  string
+}
+
+type cacheEntry struct {
+	key           cacheKey
+	registrations []Registration
+	expires       time.Time
+}
+
+func newCachingStore(store registrationStore, size int, ttl time.Duration) *cachingStore {
+	return &cachingStore{
+		registrationStore: store,
+		ttl:               ttl,
+		size:              size,
+		entries:           make(map[cacheKey]*list.Element),
+		users:             make(map[string]map[string]*list.Element),
+		lru:               list.New(),
+	}
+}
+
+func (c *cachingStore) findRegistrations(username, mailbox string) ([]Registration, error) {
+	key := cacheKey{username, mailbox}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(element)
+			c.mu.Unlock()
+			return copyRegistrations(entry.registrations), nil
+		}
+		c.remove(element)
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	registrations, err := c.registrationStore.findRegistrations(username, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if generation == c.generation {
+		c.add(&cacheEntry{key, copyRegistrations(registrations), time.Now().Add(c.ttl)})
+	}
+	c.mu.Unlock()
+
+	return registrations, nil
+}
+
+//
+// Callers get their own copy of cached registrations, so that changing
+// them does not change the cache.
+//
+
+func copyRegistrations(registrations []Registration) []Registration {
+	if registrations == nil {
+		return nil
+	}
+	copied := make([]Registration, len(registrations))
+	for i, reg := range registrations {
+		if reg.Mailboxes != nil {
+			reg.Mailboxes = append([]string(nil), reg.Mailboxes...)
+		}
+		copied[i] = reg
+	}
+	return copied
+}
+
+func (c *cachingStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	defer c.forget(username)
+	return c.registrationStore.addRegistration(username, accountId, deviceToken, subtopic, mailboxes)
+}
+
+func (c *cachingStore) importRegistration(reg Registration) error {
+	defer c.forget(reg.Username)
+	return c.registrationStore.importRegistration(reg)
+}
+
+func (c *cachingStore) deleteRegistration(reg Registration) error {
+	defer c.forget(reg.Username)
+	return c.registrationStore.deleteRegistration(reg)
+}
+
+func (c *cachingStore) expireRegistrations(before time.Time) ([]Registration, error) {
+	expired, err := c.registrationStore.expireRegistrations(before)
+	for _, reg := range expired {
+		c.forget(reg.Username)
+	}
+	return expired, err
+}
+
+//
+// Forget everything that was cached for a user. Called after the
+// registrations of the user changed, and also when changing them
+// failed, because the change may have happened anyway.
+//
+
+func (c *cachingStore) forget(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, element := range c.users[username] {
+		c.remove(element)
+	}
+}
+
+func (c *cachingStore) add(entry *cacheEntry) {
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+
+	element := c.lru.PushFront(entry)
+	c.entries[entry.key] = element
+	if c.users[entry.key.username] == nil {
+		c.users[entry.key.username] = make(map[string]*list.Element)
+	}
+	c.users[entry.key.username][entry.key.mailbox] = element
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *cachingStore) remove(element *list.Element) {
+	key := element.Value.(*cacheEntry).key
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	delete(c.users[key.username], key.mailbox)
+	if len(c.users[key.username]) == 0 {
+		delete(c.users, key.username)
+	}
+}
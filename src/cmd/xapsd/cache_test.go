@@ -0,0 +1,119 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type countingStore struct {
+	registrationStore
+	finds int
+}
+
+func (s *countingStore) findRegistrations(username, mailbox string) ([]Registration, error) {
+	s.finds++
+	return s.registrationStore.findRegistrations(username, mailbox)
+}
+
+func Test_cachingStore(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	counter := &countingStore{registrationStore: db}
+	cache := newCachingStore(counter, 10, time.Minute)
+
+	if err := cache.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if registrations, err := cache.findRegistrations("test@example.com", "Inbox"); err != nil || len(registrations) != 1 {
+			t.Error(`len(findRegistrations("Inbox")) != 1`, registrations, err)
+		}
+		if registrations, err := cache.findRegistrations("test@example.com", "Notes"); err != nil || len(registrations) != 0 {
+			t.Error(`len(findRegistrations("Notes")) != 0`, registrations, err)
+		}
+	}
+	if counter.finds != 2 {
+		t.Error("findRegistrations was not cached, lookups:", counter.finds)
+	}
+
+	// Changing a result does not change the cache
+	registrations, err := cache.findRegistrations("test@example.com", "Inbox")
+	if err != nil || len(registrations) != 1 {
+		t.Fatal(`len(findRegistrations("Inbox")) != 1`, registrations, err)
+	}
+	registrations[0].DeviceToken = "changed"
+	if registrations, err := cache.findRegistrations("test@example.com", "Inbox"); err != nil || len(registrations) != 1 || registrations[0].DeviceToken != "testtoken" {
+		t.Error(`findRegistrations("Inbox") returned a changed registration`, registrations, err)
+	}
+
+	// Registering forgets the cached registrations of the user
+	if err := cache.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox", "Notes"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	registrations, err = cache.findRegistrations("test@example.com", "Notes")
+	if err != nil || len(registrations) != 1 {
+		t.Fatal(`len(findRegistrations("Notes")) != 1 after REGISTER`, registrations, err)
+	}
+
+	if err := cache.deleteRegistration(registrations[0]); err != nil {
+		t.Error("Cannot deleteRegistration:", err)
+	}
+	if registrations, err := cache.findRegistrations("test@example.com", "Inbox"); err != nil || len(registrations) != 0 {
+		t.Error(`len(findRegistrations("Inbox")) != 0 after deleteRegistration`, registrations, err)
+	}
+}
+
+func Test_cachingStore_Limits(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	counter := &countingStore{registrationStore: db}
+	cache := newCachingStore(counter, 2, time.Minute)
+
+	cache.findRegistrations("a@example.com", "Inbox")
+	cache.findRegistrations("b@example.com", "Inbox")
+	cache.findRegistrations("a@example.com", "Inbox")
+	cache.findRegistrations("c@example.com", "Inbox")
+
+	if cache.lru.Len() != 2 || len(cache.entries) != 2 {
+		t.Error("Cache holds more entries than its size:", cache.lru.Len(), len(cache.entries))
+	}
+	if _, ok := cache.entries[cacheKey{"b@example.com", "Inbox"}]; ok {
+		t.Error("Cache did not drop the least recently used entry")
+	}
+
+	// Entries expire after the TTL
+	cache.ttl = 0
+	counter.finds = 0
+	cache.findRegistrations("d@example.com", "Inbox")
+	cache.findRegistrations("d@example.com", "Inbox")
+	if counter.finds != 2 {
+		t.Error("Expired entries were used, lookups:", counter.finds)
+	}
+}
@@ -0,0 +1,423 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sideshow/apns2/certificate"
+)
+
+//
+// Load the key and certificate from a PEM file, or from a P12 file if
+// the file cannot be parsed as PEM.
+//
+
+func loadCertificate(path string) (tls.Certificate, error) {
+	cert, _, err := readCertificate(path)
+	return cert, err
+}
+
+func readCertificate(path string) (tls.Certificate, string, error) {
+	cert, pemErr := certificate.FromPemFile(path, "")
+	if pemErr == nil {
+		return cert, "PEM", nil
+	}
+	if *debug {
+		log.Println("[DEBUG] PEM Certificate Loading Error: ", pemErr)
+	}
+
+	cert, p12Err := certificate.FromP12File(path, "")
+	if p12Err != nil {
+		return cert, "", fmt.Errorf("PEM Certificate Loading Error: %v, P12 Certificate Loading Error: %v", pemErr, p12Err)
+	}
+	return cert, "P12", nil
+}
+
+//
+// Return the number of whole days until the certificate expires. The
+// result is negative once the certificate has expired.
+//
+
+func daysToExpiry(cert *x509.Certificate, now time.Time) int {
+	return int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24))
+}
+
+//
+// Decide whether an expiry warning is due. Each threshold from
+// Config.APNS.ExpiryWarnings is logged only once: lastWarned is the
+// threshold that was logged before, or -1 if none was. Returns the
+// threshold to remember and whether to log it.
+//
+
+func expiryWarning(days int, thresholds []int, lastWarned int) (int, bool) {
+	sorted := append([]int(nil), thresholds...)
+	sort.Ints(sorted)
+	for _, threshold := range sorted {
+		if days <= threshold {
+			if lastWarned != -1 && threshold >= lastWarned {
+				return lastWarned, false
+			}
+			return threshold, true
+		}
+	}
+	return -1, false
+}
+
+func checkCertificateExpiry(identities *pushIdentities) {
+	now := time.Now()
+	for _, identity := range identities.all {
+		identity.mu.Lock()
+		checkIdentityExpiry(identity, now)
+		identity.mu.Unlock()
+	}
+}
+
+func checkIdentityExpiry(identity *pushIdentity, now time.Time) {
+	days := daysToExpiry(identity.leaf, now)
+	if days < 0 {
+		log.Printf("Certificate %s for identity %s has expired on %s", identity.certificate, identity.name, identity.leaf.NotAfter.Format(time.RFC1123))
+		return
+	}
+
+	threshold, warn := expiryWarning(days, Config.APNS.ExpiryWarnings, identity.expiryWarned)
+	identity.expiryWarned = threshold
+	if warn {
+		log.Printf("Certificate %s for identity %s expires in %d days on %s", identity.certificate, identity.name, days, identity.leaf.NotAfter.Format(time.RFC1123))
+	} else if *debug {
+		log.Printf("[DEBUG] Certificate for identity %s expires in %d days", identity.name, days)
+	}
+}
+
+//
+// Check the certificates once at startup and then periodically, at
+// Config.APNS.ExpiryCheckInterval.
+//
+
+func monitorCertificateExpiry(identities *pushIdentities) {
+	checkCertificateExpiry(identities)
+
+	interval, err := time.ParseDuration(Config.APNS.ExpiryCheckInterval)
+	if err != nil || interval <= 0 {
+		log.Println("Invalid ExpiryCheckInterval, not monitoring certificate expiry: ", Config.APNS.ExpiryCheckInterval)
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			checkCertificateExpiry(identities)
+		}
+	}()
+}
+
+//
+// Reload the certificate of an identity. The new certificate must be
+// valid and issued for the same topic, because devices registered
+// with that topic. Otherwise the identity keeps using its current
+// certificate and client.
+//
+
+func reloadIdentity(identity *pushIdentity) error {
+	loaded, err := identity.load()
+	if err != nil {
+		return err
+	}
+
+	if loaded.topic != identity.topic {
+		return fmt.Errorf("Certificate for identity '%s' is for topic %s instead of %s", identity.name, loaded.topic, identity.topic)
+	}
+
+	identity.mu.Lock()
+	old := identity.client
+	identity.client = loaded.client
+	identity.leaf = loaded.leaf
+	identity.modTime = loaded.modTime
+	identity.expiryWarned = -1
+	checkIdentityExpiry(identity, time.Now())
+	identity.mu.Unlock()
+
+	// Pushes that are in progress finish on the old connections
+	old.HTTPClient.CloseIdleConnections()
+
+	log.Printf("Reloaded certificate %s for identity %s, valid until %s", identity.certificate, identity.name, loaded.leaf.NotAfter.Format(time.RFC1123))
+
+	return nil
+}
+
+func reloadCertificates(identities *pushIdentities) {
+	for _, identity := range identities.all {
+		if err := reloadIdentity(identity); err != nil {
+			log.Println("Could not reload certificate, keeping the current one: ", err)
+		}
+	}
+}
+
+//
+// Reload certificates when xapsd receives a SIGHUP, and when a
+// certificate file changes on disk. Changes are detected by polling
+// the modification time at Config.APNS.ReloadCheckInterval.
+//
+
+func watchCertificates(identities *pushIdentities) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP, reloading certificates")
+			reloadCertificates(identities)
+		}
+	}()
+
+	interval, err := time.ParseDuration(Config.APNS.ReloadCheckInterval)
+	if err != nil || interval <= 0 {
+		if *debug {
+			log.Println("[DEBUG] Not watching certificate files for changes")
+		}
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			for _, identity := range identities.all {
+				info, err := os.Stat(identity.certificate)
+				if err != nil {
+					continue
+				}
+
+				identity.mu.RLock()
+				changed := !info.ModTime().Equal(identity.modTime)
+				identity.mu.RUnlock()
+
+				if changed {
+					log.Println("Certificate file changed, reloading", identity.certificate)
+					if err := reloadIdentity(identity); err != nil {
+						log.Println("Could not reload certificate, keeping the current one: ", err)
+
+						// Do not try again until the file changes again
+						identity.mu.Lock()
+						identity.modTime = info.ModTime()
+						identity.mu.Unlock()
+					}
+				}
+			}
+		}
+	}()
+}
+
+//
+// Run the cert subcommand:
+//
+//  xapsd cert inspect [file ...]
+//
+// Inspect loads each certificate the same way the daemon does, prints
+// what it finds and lists every problem that would keep push from
+// working. Without files it inspects the configured certificates, with
+// the -certificate flag applied like the daemon does.
+//
+
+func runCert(config string, args []string) error {
+	if len(args) == 0 || args[0] != "inspect" {
+		return usageError("cert inspect [file ...]")
+	}
+
+	files := args[1:]
+	if len(files) == 0 {
+		if err := loadConfig(config); err != nil {
+			return err
+		}
+		if *certfile != "" {
+			Config.Certificate = *certfile
+		}
+		if len(Config.Identities) == 0 {
+			files = append(files, Config.Certificate)
+		}
+		for _, identity := range Config.Identities {
+			files = append(files, identity.Certificate)
+		}
+	}
+
+	failed := 0
+	for i, file := range files {
+		if i > 0 {
+			fmt.Println()
+		}
+		if !inspectCertificate(file) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d certificates have problems", failed, len(files))
+	}
+	return nil
+}
+
+func inspectCertificate(path string) bool {
+	fmt.Printf("File:        %s\n", path)
+
+	cert, format, err := readCertificate(path)
+	if err != nil {
+		printProblems([]string{"Cannot load the file: " + err.Error()})
+		return false
+	}
+	fmt.Printf("Format:      %s\n", format)
+
+	if cert.Leaf != nil {
+		now := time.Now()
+		topic, err := topicFromCertificate(cert.Leaf)
+		if err != nil {
+			topic = "(none)"
+		}
+		fmt.Printf("Subject:     %s\n", cert.Leaf.Subject)
+		fmt.Printf("Topic:       %s\n", topic)
+		fmt.Printf("Issuer:      %s\n", cert.Leaf.Issuer)
+		fmt.Printf("Valid from:  %s\n", cert.Leaf.NotBefore.Format(time.RFC1123))
+		fmt.Printf("Valid until: %s (%d days left)\n", cert.Leaf.NotAfter.Format(time.RFC1123), daysToExpiry(cert.Leaf, now))
+	}
+	fmt.Printf("Key type:    %s\n", describeKey(cert.PrivateKey))
+	if err := checkKeyPair(cert); err == nil {
+		fmt.Println("Key matches: yes")
+	} else {
+		fmt.Println("Key matches: no")
+	}
+
+	if warnings := certificateWarnings(cert, time.Now(), Config.APNS.ExpiryWarnings); len(warnings) != 0 {
+		fmt.Println("Warnings:")
+		for _, warning := range warnings {
+			fmt.Println("  - " + warning)
+		}
+	}
+
+	problems := certificateProblems(cert, time.Now())
+	printProblems(problems)
+	return len(problems) == 0
+}
+
+func printProblems(problems []string) {
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+		return
+	}
+	fmt.Println("Problems:")
+	for _, problem := range problems {
+		fmt.Println("  - " + problem)
+	}
+}
+
+//
+// Return everything that is wrong with a certificate for use as an
+// APNS push certificate.
+//
+
+func certificateProblems(cert tls.Certificate, now time.Time) []string {
+	problems := []string{}
+
+	if cert.Leaf == nil {
+		problems = append(problems, "The file does not contain a certificate")
+	} else {
+		if _, err := topicFromCertificate(cert.Leaf); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if !strings.Contains(cert.Leaf.Issuer.String(), "Apple") {
+			problems = append(problems, "The certificate was not issued by Apple: "+cert.Leaf.Issuer.String())
+		}
+		if now.Before(cert.Leaf.NotBefore) {
+			problems = append(problems, "The certificate is not valid before "+cert.Leaf.NotBefore.Format(time.RFC1123))
+		}
+		if daysToExpiry(cert.Leaf, now) < 0 {
+			problems = append(problems, "The certificate has expired on "+cert.Leaf.NotAfter.Format(time.RFC1123))
+		}
+	}
+
+	if cert.PrivateKey == nil {
+		problems = append(problems, "The file does not contain a private key, or it is encrypted")
+	} else if cert.Leaf != nil {
+		if err := checkKeyPair(cert); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems
+}
+
+//
+// A certificate that expires within the largest of
+// Config.APNS.ExpiryWarnings still works, so that is only a warning.
+//
+
+func certificateWarnings(cert tls.Certificate, now time.Time, thresholds []int) []string {
+	if cert.Leaf == nil {
+		return nil
+	}
+	days := daysToExpiry(cert.Leaf, now)
+	for _, threshold := range thresholds {
+		if days >= 0 && days <= threshold {
+			return []string{fmt.Sprintf("The certificate expires in %d days", days)}
+		}
+	}
+	return nil
+}
+
+func checkKeyPair(cert tls.Certificate) error {
+	if cert.Leaf == nil || cert.PrivateKey == nil {
+		return errors.New("Missing certificate or private key")
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("Unsupported private key type")
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(cert.Leaf.PublicKey) {
+		return errors.New("The private key does not belong to the certificate")
+	}
+	return nil
+}
+
+func describeKey(key crypto.PrivateKey) string {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return fmt.Sprintf("RSA %d bits", key.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case nil:
+		return "(none)"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
@@ -0,0 +1,162 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+func Test_daysToExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cert := &x509.Certificate{NotAfter: now.Add(30*24*time.Hour + time.Hour)}
+	if days := daysToExpiry(cert, now); days != 30 {
+		t.Error(`daysToExpiry != 30`, days)
+	}
+
+	cert = &x509.Certificate{NotAfter: now.Add(-time.Hour)}
+	if days := daysToExpiry(cert, now); days != -1 {
+		t.Error(`daysToExpiry != -1`, days)
+	}
+}
+
+func Test_expiryWarning(t *testing.T) {
+	thresholds := []int{30, 14, 7}
+
+	if _, warn := expiryWarning(45, thresholds, -1); warn {
+		t.Error(`expiryWarning(45) warned`)
+	}
+
+	if threshold, warn := expiryWarning(30, thresholds, -1); !warn || threshold != 30 {
+		t.Error(`expiryWarning(30) != 30, true`, threshold, warn)
+	}
+
+	if threshold, warn := expiryWarning(20, thresholds, 30); warn || threshold != 30 {
+		t.Error(`expiryWarning(20) warned twice for 30`, threshold, warn)
+	}
+
+	if threshold, warn := expiryWarning(13, thresholds, 30); !warn || threshold != 14 {
+		t.Error(`expiryWarning(13) != 14, true`, threshold, warn)
+	}
+
+	if threshold, warn := expiryWarning(2, thresholds, -1); !warn || threshold != 7 {
+		t.Error(`expiryWarning(2) != 7, true`, threshold, warn)
+	}
+}
+
+func Test_reloadIdentity_KeepsCurrentOnFailure(t *testing.T) {
+	leaf := &x509.Certificate{NotAfter: time.Now().Add(90 * 24 * time.Hour)}
+	client := apns2.NewClient(tls.Certificate{Leaf: leaf})
+	identity := &pushIdentity{name: "mail", certificate: "testdata/doesnotexist.pem", topic: "com.apple.mail.XServer.1", client: client, leaf: leaf}
+
+	if err := reloadIdentity(identity); err == nil {
+		t.Error("reloadIdentity did not fail for a missing certificate")
+	}
+
+	if current, currentLeaf := identity.current(); current != client || currentLeaf != leaf {
+		t.Error("reloadIdentity replaced the client after a failed reload")
+	}
+}
+
+func testCertificate(t *testing.T, names []pkix.AttributeTypeAndValue, notAfter time.Time) tls.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("Cannot generate key:", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{ExtraNames: names},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	// Push certificates have the topic first in the subject
+	issuer := *template
+	issuer.Subject = pkix.Name{CommonName: "Apple Push Test"}
+	der, err := x509.CreateCertificate(rand.Reader, template, &issuer, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("Cannot create certificate:", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Cannot parse certificate:", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func Test_certificateProblems(t *testing.T) {
+	uid := []pkix.AttributeTypeAndValue{{Type: []int{0, 9, 2342, 19200300, 100, 1, 1}, Value: "com.apple.mail.XServer.1"}}
+	now := time.Now()
+
+	if true {
+		cert := testCertificate(t, uid, now.Add(365*24*time.Hour))
+		if problems := certificateProblems(cert, now); len(problems) != 0 {
+			t.Error("certificateProblems found problems in a good certificate:", problems)
+		}
+		if topic, err := topicFromCertificate(cert.Leaf); err != nil || topic != "com.apple.mail.XServer.1" {
+			t.Error(`topicFromCertificate != "com.apple.mail.XServer.1"`, topic, err)
+		}
+	}
+
+	if true {
+		cert := testCertificate(t, nil, now.Add(365*24*time.Hour))
+		if problems := certificateProblems(cert, now); len(problems) != 1 {
+			t.Error("certificateProblems did not report the missing topic:", problems)
+		}
+	}
+
+	if true {
+		cert := testCertificate(t, uid, now.Add(-time.Minute))
+		cert.PrivateKey = testCertificate(t, uid, now.Add(time.Hour)).PrivateKey
+		if problems := certificateProblems(cert, now); len(problems) != 2 {
+			t.Error("certificateProblems did not report expiry and key mismatch:", problems)
+		}
+	}
+
+	// Expiring soon is a warning, not a problem
+	if true {
+		cert := testCertificate(t, uid, now.Add(20*24*time.Hour))
+		if problems := certificateProblems(cert, now); len(problems) != 0 {
+			t.Error("certificateProblems reported a certificate that expires soon:", problems)
+		}
+		if warnings := certificateWarnings(cert, now, []int{30, 14, 7}); len(warnings) != 1 {
+			t.Error("certificateWarnings did not warn about a certificate that expires in 20 days:", warnings)
+		}
+		if warnings := certificateWarnings(cert, now, []int{14, 7}); len(warnings) != 0 {
+			t.Error("certificateWarnings ignored the configured thresholds:", warnings)
+		}
+	}
+}
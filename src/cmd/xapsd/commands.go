@@ -0,0 +1,88 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/configor"
+)
+
+//
+// Besides running as a daemon, xapsd has a number of administrative
+// subcommands. They are given after the flags, for example:
+//
+//  xapsd -config /etc/xapsd.toml cert inspect /etc/xapsd/certificate.pem
+//
+
+type subcommand struct {
+	name  string
+	usage string
+	run   func(config string, args []string) error
+}
+
+var subcommands = []subcommand{
+	{"cert", "cert inspect [file ...]", runCert},
+	{"migrate", "migrate status|up", runMigrate},
+	{"export", "export [-format json|csv] [file]", runExport},
+	{"import", "import [-format json|csv] [file]", runImport},
+	{"import-legacy", "import-legacy [-dry-run] file", runImportLegacy},
+	{"duplicates", "duplicates", runDuplicates},
+	{"encrypt", "encrypt", runEncrypt},
+	{"audit", "audit username", runAudit},
+	{"remove", "remove username [account-id]", runRemove},
+}
+
+func runSubcommand(config string, args []string) int {
+	for _, cmd := range subcommands {
+		if cmd.name == args[0] {
+			if err := cmd.run(config, args[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "xapsd %s: %v\n", cmd.name, err)
+				return 1
+			}
+			return 0
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\nUsage: xapsd [flags] <command>\n\nCommands:\n", args[0])
+	for _, cmd := range subcommands {
+		fmt.Fprintln(os.Stderr, "  "+cmd.usage)
+	}
+	return 2
+}
+
+func loadConfig(config string) error {
+	if _, err := os.Stat(config); err != nil {
+		return errors.New("Config file does not exist " + config)
+	}
+	return configor.Load(&Config, config)
+}
+
+func usageError(usage ...string) error {
+	return errors.New("usage: xapsd " + strings.Join(usage, "\n       xapsd "))
+}
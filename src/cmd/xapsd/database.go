@@ -25,24 +25,78 @@
 package main
 
 import (
+	"sort"
 	"strings"
 	"log"
 	"strconv"
+	"sync"
 	"database/sql"
 	_ "github.com/go-sql-driver/mysql"
 	"fmt"
 	"time"
 )
 
-type Registration struct {
-	DbId        int
-	DeviceToken string
-	AccountId   string
+//
+// The mysql storage driver keeps registrations in tables that are
+// accessed with the queries from Config.DB.Queries.
+//
+
+type sqlStore struct {
+	conn      *sql.DB
+	dialect   *sqlDialect
+	queries   map[string]*sql.Stmt
+	userLocks keyedMutex
+
+	// The replica is connected again by ping if it failed, so it is
+	// guarded by replicaMu. Only one ping at a time connects it.
+	replicaDSN     string
+	replicaSQL     map[string]string
+	replicaConnect sync.Mutex
+	replicaMu      sync.RWMutex
+	replica        *sql.DB
+	replicaQueries map[string]*sql.Stmt
+}
+
+//
+// The queries that run on the read replica, if one is configured.
+// Queries that run in the REGISTER transaction always use the primary,
+// so that REGISTER sees its own changes.
+//
+
+var replicaQueryNames = []string{"find_registration", "get_aps_mailboxes", "list_registrations"}
+
+//
+// A dialect describes a database/sql driver that can hold the
+// registrations. Queries are always written with ? placeholders and
+// rebind translates them for drivers that use another style. The
+// migrations create the bundled schema; they are applied when the
+// database is opened if autoMigrate is set, and otherwise with the
+// migrate subcommand. The default queries are for that schema.
+//
+
+type sqlDialect struct {
+	driver      string
+	replicas    bool
+	dsn         func() string
+	rebind      func(query string) string
+	migrations  []migration
+	autoMigrate bool
+	queries     map[string]string
+}
+
+var sqlDialects = make(map[string]*sqlDialect)
+
+func registerSQLDialect(name string, dialect *sqlDialect) {
+	sqlDialects[name] = dialect
+	registerStorageDriver(name, func() (registrationStore, error) {
+		return connectDatabase(dialect)
+	})
 }
 
-type Database struct {
-	conn     *sql.DB
-	queries map[string]*sql.Stmt
+var mysqlDialect = &sqlDialect{driver: "mysql", replicas: true, dsn: mysqlDSN, migrations: mysqlMigrations}
+
+func init() {
+	registerSQLDialect("mysql", mysqlDialect)
 }
 
 type addMailboxes struct {
@@ -55,22 +109,34 @@ const (
 	MBX_DELETE = 2
 )
 
-func connectDatabase() (*Database, error) {
-
-	// Connect to Database
-	host := "@tcp(" + Config.DB.Host + ":" + strconv.FormatUint(uint64(Config.DB.Port), 10) + ")/"
+func mysqlDSN() string {
+	port := Config.DB.Port
+	if port == 0 {
+		port = 3306
+	}
+	host := "@tcp(" + Config.DB.Host + ":" + strconv.FormatUint(uint64(port), 10) + ")/"
 	if Config.DB.Socket != "" {
 		host = "@unix(" + Config.DB.Socket + ")/"
 	}
 
-	db_conn, err := sql.Open("mysql", Config.DB.User + ":" + Config.DB.Password + host + Config.DB.Name + "?" + Config.DB.Options)
+	options := Config.DB.Options
+	if options == "" {
+		options = "timeout=5s&collation=utf8mb4_unicode_ci"
+	}
+
+	return Config.DB.User + ":" + Config.DB.Password + host + Config.DB.Name + "?" + options
+}
+
+func openConnection(driver, dsn string) (*sql.DB, error) {
+	db_conn, err := sql.Open(driver, dsn)
         if err != nil {
 		return nil, err
 	}
 
         err = db_conn.Ping()
         if err != nil {
-		return nil, err
+		db_conn.Close()
+		return nil, unavailableError{err}
         }
 
 	// Set database connection settings
@@ -82,85 +148,375 @@ func connectDatabase() (*Database, error) {
 	db_conn.SetMaxOpenConns(Config.DB.MaxOpenConnections)
 	db_conn.SetMaxIdleConns(Config.DB.MaxIdleConnections)
 
+	return db_conn, nil
+}
 
-	var db Database = Database{conn: db_conn, queries: make(map[string]*sql.Stmt)}
+//
+// Connect to a database and prepare its queries. Queries from
+// Config.DB.Queries replace the default queries of the dialect with
+// the same name.
+//
 
-	// Prepare SQL Queries
+func connectDatabase(dialect *sqlDialect) (*sqlStore, error) {
+	db_conn, err := openConnection(dialect.driver, dialect.dsn())
+	if err != nil {
+		return nil, err
+	}
+
+	if dialect.autoMigrate {
+		if err := migrateSchema(db_conn, dialect); err != nil {
+			db_conn.Close()
+			return nil, err
+		}
+	}
+
+	var db sqlStore = sqlStore{conn: db_conn, dialect: dialect, queries: make(map[string]*sql.Stmt)}
+
+	queries := make(map[string]string)
+	for name, sql := range dialect.queries {
+		queries[name] = sql
+	}
+	if Config.DB.Preset != "" {
+		preset, ok := queryPresets[Config.DB.Preset]
+		if !ok {
+			db.close()
+			return nil, fmt.Errorf("Unknown query preset '%s'", Config.DB.Preset)
+		}
+		for name, sql := range preset {
+			queries[name] = sql
+		}
+	}
 	for name, sql := range Config.DB.Queries {
-		db.queries[name], err = db.conn.Prepare(sql.Sql)
+		queries[name] = sql.Sql
+	}
+
+	removeUnknownQueries(queries)
+
+	// Prepare SQL Queries
+	problems := []string{}
+	for name, sql := range queries {
+		if dialect.rebind != nil {
+			sql = dialect.rebind(sql)
+		}
+		stmt, err := db.conn.Prepare(sql)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to prepare query '%s': %v", name, err)
+			problems = append(problems, fmt.Sprintf("Unable to prepare query '%s': %v", name, err))
+			continue
+		}
+		db.queries[name] = stmt
+	}
+
+	// Fail now instead of on the first REGISTER or NOTIFY
+	problems = append(problems, checkQueries(&db, queries)...)
+	if _, ok := queries["find_token_registrations"]; !ok && Config.Storage.DuplicateTokens == duplicateTokensLatest {
+		problems = append(problems, "Query 'find_token_registrations' is missing, it is needed for DuplicateTokens = \"latest\"")
+	}
+	if _, ok := queries["find_user_registrations"]; !ok && Config.Limits.DevicesPerUser > 0 {
+		problems = append(problems, "Query 'find_user_registrations' is missing, it is needed for DevicesPerUser")
+	}
+	if Config.Storage.ExpireAfter != "" {
+		// Without touch_aps a REGISTER does not refresh the device,
+		// so every device would expire
+		for _, name := range []string{"touch_aps", "find_stale_registrations"} {
+			if _, ok := queries[name]; !ok {
+				problems = append(problems, fmt.Sprintf("Query '%s' is missing, it is needed for ExpireAfter", name))
+			}
+		}
+	}
+	if _, ok := queries["find_user_registrations"]; !ok && Config.Mailboxes.Patterns {
+		problems = append(problems, "Query 'find_user_registrations' is missing, it is needed for mailbox Patterns")
+	}
+	if len(Config.Identities) > 1 {
+		problems = append(problems, checkSubtopicQueries(&db, queries)...)
+	}
+	if Config.Storage.EncryptionKeyFile != "" {
+		problems = append(problems, checkEncryptionQueries(&db, queries)...)
+	}
+	if len(problems) != 0 {
+		db.close()
+		sort.Strings(problems)
+		return nil, fmt.Errorf("Invalid queries in the configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	if Config.DB.Replica != "" {
+		if !dialect.replicas {
+			db.close()
+			return nil, fmt.Errorf("The %s storage driver does not support a read replica", dialect.driver)
+		}
+		// Lookups can always go to the primary, so xapsd does not
+		// depend on the replica to start. The health checks try to
+		// connect it again.
+		db.replicaDSN, db.replicaSQL = Config.DB.Replica, queries
+		if err := db.connectReplica(Config.DB.Replica, queries); err != nil {
+			log.Println("Cannot use the read replica, reading from the primary: ", err)
 		}
 	}
 
 	return &db, nil
 }
 
-func (db *Database) addMailboxes(mailboxes map[string]*addMailboxes) error {
-	
-	if *debug {
-		log.Println("[DEBUG] Modifying Mailboxes: ", len(mailboxes))
+//
+// With several push identities the subtopic selects the identity, so
+// it must be stored and returned. Without it every registration would
+// silently use the mail identity.
+//
+
+func checkSubtopicQueries(db *sqlStore, queries map[string]string) []string {
+	problems := []string{}
+	if _, ok := queries["set_aps_subtopic"]; !ok {
+		problems = append(problems, "Query 'set_aps_subtopic' is missing, it is needed for several Identities")
 	}
-	
-	tx, err := db.conn.Begin()
+	if stmt, ok := db.queries["find_registration"]; ok {
+		columns, err := testQuery(db.conn, stmt, []interface{}{0, 0, 0})
+		if err == nil && columns < 4 {
+			problems = append(problems, "Query 'find_registration' does not return the subtopic, it is needed for several Identities")
+		}
+	}
+	return problems
+}
+
+//
+// Encrypted registrations keep their encrypted values in an extra
+// column, which must be stored and returned by every lookup.
+//
+
+func checkEncryptionQueries(db *sqlStore, queries map[string]string) []string {
+	problems := []string{}
+	for _, name := range []string{"set_aps_sealed", "find_token_registrations"} {
+		if _, ok := queries[name]; !ok {
+			problems = append(problems, fmt.Sprintf("Query '%s' is missing, it is needed for encryption", name))
+		}
+	}
+	for _, name := range []string{"find_registration", "list_registrations", "find_token_registrations", "find_user_registrations", "find_pattern_registrations", "find_stale_registrations"} {
+		stmt, ok := db.queries[name]
+		if !ok {
+			continue
+		}
+		want := 8
+		if name == "find_registration" {
+			want = 5
+		}
+		columns, err := testQuery(db.conn, stmt, testArgs(name))
+		if err == nil && columns < want {
+			problems = append(problems, fmt.Sprintf("Query '%s' does not return the encrypted values, it is needed for encryption", name))
+		}
+	}
+	return problems
+}
+
+func (db *sqlStore) connectReplica(dsn string, queries map[string]string) error {
+	conn, err := openConnection(db.dialect.driver, dsn)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-	
+
+	prepared := make(map[string]*sql.Stmt)
+	for _, name := range replicaQueryNames {
+		sql, ok := queries[name]
+		if !ok {
+			continue
+		}
+		if db.dialect.rebind != nil {
+			sql = db.dialect.rebind(sql)
+		}
+		stmt, err := conn.Prepare(sql)
+		if err != nil {
+			for _, stmt := range prepared {
+				stmt.Close()
+			}
+			conn.Close()
+			return fmt.Errorf("Unable to prepare query '%s': %w", name, err)
+		}
+		prepared[name] = stmt
+	}
+
+	db.replicaMu.Lock()
+	db.replica = conn
+	db.replicaQueries = prepared
+	db.replicaMu.Unlock()
+	return nil
+}
+
+//
+// Run a lookup on the replica if there is one. If that fails, run it
+// again on the primary.
+//
+
+func (db *sqlStore) read(name string, args ...interface{}) (*sql.Rows, error) {
+	db.replicaMu.RLock()
+	stmt, ok := db.replicaQueries[name]
+	db.replicaMu.RUnlock()
+	if ok {
+		rows, err := stmt.Query(args...)
+		if err == nil {
+			return rows, nil
+		}
+		log.Printf("Query '%s' failed on the read replica, using the primary: %v", name, err)
+	}
+	return db.queries[name].Query(args...)
+}
+
+func (db *sqlStore) addMailboxes(tx *sql.Tx, mailboxes map[string]*addMailboxes) error {
+
+	if *debug {
+		log.Println("[DEBUG] Modifying Mailboxes: ", len(mailboxes))
+	}
+
 	for mbx_name, mbx_struct := range mailboxes {
+		var err error
 		switch mbx_struct.action {
 		case MBX_INSERT:
-			tx.Stmt(db.queries["insert_aps_mailbox"]).Exec(mbx_struct.id, mbx_name)
+			_, err = tx.Stmt(db.queries["insert_aps_mailbox"]).Exec(mbx_struct.id, mbx_name)
 		case MBX_DELETE:
-			tx.Stmt(db.queries["delete_aps_mailbox"]).Exec(mbx_struct.id)
+			_, err = tx.Stmt(db.queries["delete_aps_mailbox"]).Exec(mbx_struct.id)
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot update mailbox %s: %w", mbx_name, err)
 		}
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return err
 	}
 
 	return nil
 }
 
-func (db *Database) addRegistration(username, accountId, deviceToken string, mailboxes []string) error {
+//
+// Register a device. Everything happens in a single transaction, so a
+// failure leaves the registration as it was. REGISTERs for the same
+// user are serialized, so that concurrent REGISTERs for a device cannot
+// both decide to insert it.
+//
+
+func (db *sqlStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	_, err := db.register(Registration{Username: username, AccountId: accountId, DeviceToken: deviceToken, Subtopic: subtopic, Mailboxes: mailboxes})
+	return err
+}
+
+//
+// Add a registration with its original times, for example from an
+// export. The times are only kept if there is a set_aps_times query;
+// new registrations get the current time with that query as well.
+//
+
+func (db *sqlStore) importRegistration(reg Registration) error {
+	_, err := db.register(reg)
+	return err
+}
+
+func (db *sqlStore) register(reg Registration) (*Registration, error) {
+	username, accountId, deviceToken, subtopic, mailboxes := reg.Username, reg.AccountId, reg.DeviceToken, reg.Subtopic, reg.Mailboxes
+	created, lastRegistered := reg.Created, reg.LastRegistered
+	if _, ok := db.queries["set_aps_sealed"]; !ok && reg.Sealed != "" {
+		return nil, fmt.Errorf("Storing encrypted registrations needs a set_aps_sealed query")
+	}
+	defer db.userLocks.lock(username)()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	s := strings.Split(username, "@")
+	local, domain := splitUsername(username)
+	now := time.Now().UTC()
 	var (
 		mbxid uint32
 		apsid int64
 		aps_mbxid int64
 		aps_mbx_name string
 	)
-	query := db.queries
+	query := func(name string) *sql.Stmt {
+		return tx.Stmt(db.queries[name])
+	}
 
-	// Get mailbox id
-	err := query["select_mbx_id"].QueryRow(s[0], s[1]).Scan(&mbxid)
+	// Get mailbox id. Stores that keep their own list of users can
+	// have it created with the optional insert_mbx_id query. That
+	// query inserts nothing for users that it does not know.
+	err = query("select_mbx_id").QueryRow(local, domain).Scan(&mbxid)
+	if _, ok := db.queries["insert_mbx_id"]; ok && err == sql.ErrNoRows {
+		var res sql.Result
+		res, err = query("insert_mbx_id").Exec(local, domain)
+		if err == nil {
+			var n int64
+			if n, err = res.RowsAffected(); err == nil && n == 0 {
+				err = sql.ErrNoRows
+			} else if err == nil {
+				err = query("select_mbx_id").QueryRow(local, domain).Scan(&mbxid)
+			}
+		}
+	}
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Unknown user %s", username)
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Cannot look up user %s: %w", username, err)
 	}
 	if *debug {
 		log.Println("[DEBUG] Query Mailbox ID:", mbxid)
 	}
-	
+
 	// Get or insert account into aps table
-	err = query["select_aps_settings_id"].QueryRow(mbxid, accountId, deviceToken).Scan(&apsid)
+	var previous *Registration
+	err = query("select_aps_settings_id").QueryRow(mbxid, accountId, deviceToken).Scan(&apsid)
 	switch {
 	case err == sql.ErrNoRows:
-		res, err := query["insert_aps"].Exec(mbxid, accountId, deviceToken)
+		res, err := query("insert_aps").Exec(mbxid, accountId, deviceToken)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("Cannot insert registration: %w", err)
 		}
 		apsid, err = res.LastInsertId()
+		if err != nil {
+			// Not every driver supports LastInsertId
+			err = query("select_aps_settings_id").QueryRow(mbxid, accountId, deviceToken).Scan(&apsid)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot look up new registration: %w", err)
+			}
+		}
 		if *debug {
 			log.Println("[DEBUG] Registered Account: ", mbxid, apsid)
 		}
+		if created.IsZero() || lastRegistered.IsZero() {
+			created, lastRegistered = now, now
+		}
 	case err != nil:
-		return err
+		return nil, fmt.Errorf("Cannot look up registration: %w", err)
+	default:
+		previous = &Registration{DbId: int(apsid), Username: username, AccountId: accountId, DeviceToken: deviceToken, Mailboxes: []string{}}
+
+		// Remember that the device is still around. The optional
+		// touch_aps query updates the last registration time.
+		if _, ok := db.queries["touch_aps"]; ok {
+			if _, err := query("touch_aps").Exec(now, apsid); err != nil {
+				return nil, fmt.Errorf("Cannot update registration time: %w", err)
+			}
+		}
+	}
+
+	// Remember which push identity the account registered with. This
+	// is optional so that existing setups without a subtopic column
+	// keep working; their registrations are treated as mail.
+	if _, ok := db.queries["set_aps_subtopic"]; ok {
+		_, err = query("set_aps_subtopic").Exec(subtopic, apsid)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot set subtopic: %w", err)
+		}
+	}
+
+	// The encrypted values get a new data key on every REGISTER
+	if reg.Sealed != "" {
+		if _, err := query("set_aps_sealed").Exec(reg.Sealed, apsid); err != nil {
+			return nil, fmt.Errorf("Cannot set encrypted values: %w", err)
+		}
+	}
+
+	// Times are passed in UTC. CURRENT_TIMESTAMP in a query would be
+	// the local time of the database server, which columns without a
+	// time zone do not record.
+	if _, ok := db.queries["set_aps_times"]; ok && !created.IsZero() && !lastRegistered.IsZero() {
+		_, err = query("set_aps_times").Exec(created.UTC(), lastRegistered.UTC(), apsid)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot set registration times: %w", err)
+		}
 	}
-	
+
 	// Add mailboxes to a map
 	map_mailboxes := make(map[string]*addMailboxes, 4)
 	for _, m := range mailboxes {
@@ -168,40 +524,77 @@ func (db *Database) addRegistration(username, accountId, deviceToken string, mai
 	}
 
 	// Figure out which mailboxes need to be added/removed
-	rows, err := query["get_aps_mailboxes"].Query(apsid)
+	rows, err := query("get_aps_mailboxes").Query(apsid)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			err = db.addMailboxes(map_mailboxes)
-		}
-		return err
+		return nil, fmt.Errorf("Cannot look up mailboxes: %w", err)
 	}
 	defer rows.Close()
-	
+
 	for rows.Next() {
-		_ = rows.Scan(&aps_mbxid, &aps_mbx_name)
+		if err := rows.Scan(&aps_mbxid, &aps_mbx_name); err != nil {
+			return nil, fmt.Errorf("Cannot look up mailboxes: %w", err)
+		}
+		if previous != nil {
+			previous.Mailboxes = append(previous.Mailboxes, aps_mbx_name)
+		}
 		if _, ok := map_mailboxes[aps_mbx_name]; ok {
 			delete(map_mailboxes, aps_mbx_name)
 		} else {
 			map_mailboxes[aps_mbx_name] = &addMailboxes{aps_mbxid, MBX_DELETE}
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot look up mailboxes: %w", err)
+	}
 	rows.Close()
-	
+
 	// Add mailboxes if required
 	if len(map_mailboxes) > 0 {
-		err = db.addMailboxes(map_mailboxes)
+		err = db.addMailboxes(tx, map_mailboxes)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return previous, nil
 }
 
-func (db *Database) findRegistrations(username, mailbox string) ([]Registration, error) {
+//
+// Find out whether registrations for a user would be accepted, the same
+// way register does, without changing anything.
+//
+
+func (db *sqlStore) knowsUser(username string) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	local, domain := splitUsername(username)
+	var mbxid uint32
+	err = tx.Stmt(db.queries["select_mbx_id"]).QueryRow(local, domain).Scan(&mbxid)
+	if _, ok := db.queries["insert_mbx_id"]; ok && err == sql.ErrNoRows {
+		res, err := tx.Stmt(db.queries["insert_mbx_id"]).Exec(local, domain)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n > 0, err
+	}
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *sqlStore) findRegistrations(username, mailbox string) ([]Registration, error) {
 	var registrations []Registration
-	s := strings.Split(username, "@")
-	rows, err := db.queries["find_registration"].Query(mailbox, s[0], s[1])
+	local, domain := splitUsername(username)
+	rows, err := db.read("find_registration", mailbox, local, domain)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = nil
@@ -210,25 +603,103 @@ func (db *Database) findRegistrations(username, mailbox string) ([]Registration,
 	}
 	defer rows.Close()
 
-	var (
-		dbid int
-		devicetoken string
-		accountId string
-	)
+	// The query may return the subtopic as an optional fourth column,
+	// and the encrypted values as a fifth
+	columns, err := rows.Columns()
+	if err != nil {
+		return registrations, err
+	}
 
 	for rows.Next() {
-		_ = rows.Scan(&dbid, &accountId, &devicetoken)
+		var (
+			dbid int
+			devicetoken string
+			accountId string
+			subtopic sql.NullString
+			sealed sql.NullString
+		)
+		switch {
+		case len(columns) > 4:
+			err = rows.Scan(&dbid, &accountId, &devicetoken, &subtopic, &sealed)
+		case len(columns) > 3:
+			err = rows.Scan(&dbid, &accountId, &devicetoken, &subtopic)
+		default:
+			err = rows.Scan(&dbid, &accountId, &devicetoken)
+		}
+		if err != nil {
+			return nil, err
+		}
 		registrations = append(registrations,
-			Registration{DbId: dbid, DeviceToken: devicetoken, AccountId: accountId})
+			Registration{DbId: dbid, Username: username, DeviceToken: devicetoken, AccountId: accountId, Subtopic: subtopic.String, Sealed: sealed.String})
 		if *debug {
 			log.Println("[DEBUG] Found Registration:", devicetoken, accountId)
 		}
 	}
 
-	return registrations, nil
+	return registrations, rows.Err()
+}
+
+//
+// Find all registrations of a device token, with their mailboxes, with
+// the optional find_token_registrations query. It returns the same
+// columns as list_registrations.
+//
+
+func (db *sqlStore) findTokenRegistrations(deviceToken string) ([]Registration, error) {
+	query, ok := db.queries["find_token_registrations"]
+	if !ok {
+		return nil, fmt.Errorf("Looking up device tokens needs a find_token_registrations query")
+	}
+
+	rows, err := query.Query(deviceToken)
+	if err != nil {
+		return nil, err
+	}
+	return db.scanRegistrationsWithMailboxes(rows)
+}
+
+//
+// Find all registrations of a user, with their mailboxes, with the
+// optional find_user_registrations query. It takes the local part and
+// the domain and returns the same columns as list_registrations.
+//
+
+func (db *sqlStore) userRegistrations(username string) ([]Registration, error) {
+	query, ok := db.queries["find_user_registrations"]
+	if !ok {
+		return nil, fmt.Errorf("Looking up the devices of a user needs a find_user_registrations query")
+	}
+
+	local, domain := splitUsername(username)
+	rows, err := query.Query(local, domain)
+	if err != nil {
+		return nil, err
+	}
+	return db.scanRegistrationsWithMailboxes(rows)
+}
+
+//
+// Find the registrations of a user that have mailbox patterns with the
+// optional find_pattern_registrations query, so that a NOTIFY for a
+// user without patterns does not look up all their mailboxes. Without
+// the query every registration of the user is checked.
+//
+
+func (db *sqlStore) patternRegistrations(username string) ([]Registration, error) {
+	query, ok := db.queries["find_pattern_registrations"]
+	if !ok {
+		return db.userRegistrations(username)
+	}
+
+	local, domain := splitUsername(username)
+	rows, err := query.Query(local, domain)
+	if err != nil {
+		return nil, err
+	}
+	return db.scanRegistrationsWithMailboxes(rows)
 }
 
-func (db *Database) deleteRegistration(reg Registration) error {
+func (db *sqlStore) deleteRegistration(reg Registration) error {
 
 	_, err := db.queries["delete_registration"].Exec(reg.DbId)
 	if err != nil {
@@ -237,3 +708,236 @@ func (db *Database) deleteRegistration(reg Registration) error {
 
 	return nil
 }
+
+//
+// Listing all registrations needs the optional list_registrations
+// query, which returns the id, username, account id and device token
+// and optionally the subtopic of every registration, followed by the
+// creation and last registration time. The mailboxes are looked up
+// with get_aps_mailboxes.
+//
+
+func (db *sqlStore) listRegistrations() ([]Registration, error) {
+	if _, ok := db.queries["list_registrations"]; !ok {
+		return nil, fmt.Errorf("Listing registrations needs a list_registrations query")
+	}
+
+	rows, err := db.read("list_registrations")
+	if err != nil {
+		return nil, err
+	}
+	return db.scanRegistrationsWithMailboxes(rows)
+}
+
+//
+// Delete the registrations that were last registered before the given
+// time. The optional find_stale_registrations query takes that time and
+// returns the same columns as list_registrations.
+//
+
+func (db *sqlStore) expireRegistrations(before time.Time) ([]Registration, error) {
+	if _, ok := db.queries["find_stale_registrations"]; !ok {
+		return nil, fmt.Errorf("Expiring registrations needs a find_stale_registrations query")
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Stmt(db.queries["find_stale_registrations"]).Query(before.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	registrations, err := scanRegistrations(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reg := range registrations {
+		if _, err := tx.Stmt(db.queries["delete_registration"]).Exec(reg.DbId); err != nil {
+			return nil, fmt.Errorf("Cannot delete registration %d: %w", reg.DbId, err)
+		}
+	}
+
+	return registrations, tx.Commit()
+}
+
+func (db *sqlStore) scanRegistrationsWithMailboxes(rows *sql.Rows) ([]Registration, error) {
+	registrations, err := scanRegistrations(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range registrations {
+		registrations[i].Mailboxes, err = db.getMailboxes(registrations[i].DbId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return registrations, nil
+}
+
+func scanRegistrations(rows *sql.Rows) ([]Registration, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var registrations []Registration
+	for rows.Next() {
+		var (
+			reg Registration
+			subtopic, sealed sql.NullString
+			created, lastRegistered sqlTime
+		)
+		switch {
+		case len(columns) > 7:
+			err = rows.Scan(&reg.DbId, &reg.Username, &reg.AccountId, &reg.DeviceToken, &subtopic, &created, &lastRegistered, &sealed)
+		case len(columns) > 5:
+			err = rows.Scan(&reg.DbId, &reg.Username, &reg.AccountId, &reg.DeviceToken, &subtopic, &created, &lastRegistered)
+		case len(columns) > 4:
+			err = rows.Scan(&reg.DbId, &reg.Username, &reg.AccountId, &reg.DeviceToken, &subtopic)
+		default:
+			err = rows.Scan(&reg.DbId, &reg.Username, &reg.AccountId, &reg.DeviceToken)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reg.Subtopic = subtopic.String
+		reg.Sealed = sealed.String
+		reg.Created = created.Time
+		reg.LastRegistered = lastRegistered.Time
+		registrations = append(registrations, reg)
+	}
+
+	return registrations, rows.Err()
+}
+
+//
+// Drivers return timestamps in different ways: as a time.Time, or as
+// text when the MySQL driver runs without parseTime. A sqlTime scans
+// all of them, and NULL as the zero time. Times without a zone are UTC.
+//
+
+type sqlTime struct {
+	time.Time
+}
+
+var sqlTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func (t *sqlTime) Scan(value interface{}) error {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v
+		return nil
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return fmt.Errorf("Cannot scan %T into a time", value)
+	}
+
+	for _, layout := range sqlTimeLayouts {
+		if parsed, err := time.ParseInLocation(layout, text, time.UTC); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("Cannot parse time '%s'", text)
+}
+
+func (db *sqlStore) getMailboxes(apsid int) ([]string, error) {
+	rows, err := db.read("get_aps_mailboxes", apsid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mailboxes := []string{}
+	for rows.Next() {
+		var (
+			id int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		mailboxes = append(mailboxes, name)
+	}
+
+	return mailboxes, rows.Err()
+}
+
+//
+// Check the primary, and connect the read replica if it could not be
+// connected before.
+//
+
+func (db *sqlStore) ping() error {
+	if err := db.conn.Ping(); err != nil {
+		return err
+	}
+
+	db.replicaConnect.Lock()
+	defer db.replicaConnect.Unlock()
+
+	db.replicaMu.RLock()
+	missing := db.replicaDSN != "" && db.replica == nil
+	db.replicaMu.RUnlock()
+	if missing {
+		if err := db.connectReplica(db.replicaDSN, db.replicaSQL); err != nil {
+			log.Println("Cannot use the read replica, reading from the primary: ", err)
+		} else {
+			log.Println("Reading from the read replica again")
+		}
+	}
+	return nil
+}
+
+func (db *sqlStore) status() []statusValue {
+	stats := db.conn.Stats()
+	status := []statusValue{
+		{"storage-open-connections", strconv.Itoa(stats.OpenConnections)},
+		{"storage-in-use-connections", strconv.Itoa(stats.InUse)},
+	}
+	db.replicaMu.RLock()
+	defer db.replicaMu.RUnlock()
+	if db.replica != nil {
+		stats = db.replica.Stats()
+		status = append(status,
+			statusValue{"storage-replica-open-connections", strconv.Itoa(stats.OpenConnections)},
+			statusValue{"storage-replica-in-use-connections", strconv.Itoa(stats.InUse)})
+	}
+	return status
+}
+
+func (db *sqlStore) close() error {
+	db.replicaMu.Lock()
+	defer db.replicaMu.Unlock()
+	for _, stmt := range db.replicaQueries {
+		stmt.Close()
+	}
+	if db.replica != nil {
+		db.replica.Close()
+	}
+	for _, stmt := range db.queries {
+		stmt.Close()
+	}
+	return db.conn.Close()
+}
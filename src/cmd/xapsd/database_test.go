@@ -27,126 +27,328 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-func Test_newDatabase(t *testing.T) {
-	db, err := newDatabase("testdata/database.json")
+func openTestDatabase(t *testing.T) (*sqlStore, func()) {
+	dir, err := ioutil.TempDir("", "database_test")
 	if err != nil {
-		t.Error("Cannot open database testdata/database.json", err)
+		t.Fatal("Can't create temporary directory", err)
 	}
 
-	if db.filename != "testdata/database.json" {
-		t.Error(`db.filename != "testdata/database.json"`)
+	path := Config.Storage.SQLite
+	Config.Storage.SQLite = filepath.Join(dir, "xapsd.db")
+	db, err := storageDrivers["sqlite"]()
+	if err != nil {
+		Config.Storage.SQLite = path
+		os.RemoveAll(dir)
+		t.Fatal("Cannot open database", err)
+	}
+
+	return db.(*sqlStore), func() {
+		db.close()
+		Config.Storage.SQLite = path
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_sqlStore_Registrations(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	if err := db.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox", "Spam"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	if err := db.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox", "Ham"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+
+	if registrations, err := db.findRegistrations("test@example.com", "Inbox"); err != nil || len(registrations) != 2 {
+		t.Error(`len(findRegistrations("Inbox")) != 2`, registrations, err)
+	}
+
+	// Registering again replaces the mailboxes
+	if err := db.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox", "Ham"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
 	}
 
-	if len(db.Users) != 2 {
-		t.Error("len(db.Users) != 2")
+	if registrations, err := db.findRegistrations("test@example.com", "Spam"); err != nil || len(registrations) != 0 {
+		t.Error(`len(findRegistrations("Spam")) != 0`, registrations, err)
 	}
 
-	if len(db.Users["stefan"].Accounts) != 2 {
-		t.Error(`db.Users["stefan"].Accounts) != 1`)
+	registrations, err := db.findRegistrations("test@example.com", "Ham")
+	if err != nil || len(registrations) != 2 {
+		t.Fatal(`len(findRegistrations("Ham")) != 2`, registrations, err)
+	}
+	if registrations[0].Subtopic != "com.apple.mobilemail" {
+		t.Error(`Subtopic != "com.apple.mobilemail"`, registrations[0].Subtopic)
+	}
+
+	if err := db.deleteRegistration(registrations[0]); err != nil {
+		t.Error("Cannot deleteRegistration:", err)
 	}
 
-	if len(db.Users["alice"].Accounts) != 1 {
-		t.Error(`db.Users["alice"].Accounts) != 1`)
+	list, err := db.listRegistrations()
+	if err != nil {
+		t.Error("Cannot listRegistrations:", err)
+	}
+	if len(list) != 1 || list[0].Username != "test@example.com" || len(list[0].Mailboxes) != 2 {
+		t.Error(`listRegistrations() != one registration with two mailboxes`, list)
 	}
 }
 
-func Test_addRegistration(t *testing.T) {
-	f, err := ioutil.TempFile("/tmp", "database_test_Test_addRegistration")
+//
+// A row that cannot be scanned fails the lookup, instead of being
+// returned with the values of the row before it.
+//
+
+func Test_sqlStore_FindRegistrationsScanError(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	stmt, err := db.conn.Prepare(`SELECT 1, 'testaccountid1', 'testtoken1', '' WHERE ? IS NOT NULL AND ? IS NOT NULL AND ? IS NOT NULL
+		UNION ALL SELECT 2, 'testaccountid2', NULL, ''`)
 	if err != nil {
-		t.Error("Can't create temporary file", err)
+		t.Fatal("Cannot prepare query:", err)
 	}
-	defer os.Remove(f.Name())
+	db.queries["find_registration"] = stmt
 
-	if true {
-		db, err := newDatabase(f.Name())
-		if err != nil {
-			t.Error("Cannot open database", err)
-		}
+	if registrations, err := db.findRegistrations("test@example.com", "Inbox"); err == nil {
+		t.Error("findRegistrations did not fail on a NULL device token:", registrations)
+	}
+}
 
-		if err := db.addRegistration("test@example.com", "testaccountid1", "testtoken1", []string{"Inbox", "Spam"}); err != nil {
-			t.Error("Cannot addRegistration:", err)
-		}
+func Test_sqlStore_ConcurrentRegistrations(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
 
-		if err := db.addRegistration("test@example.com", "testaccountid2", "testtoken2", []string{"Inbox", "Ham"}); err != nil {
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- db.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox", "Notes"})
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
 			t.Error("Cannot addRegistration:", err)
 		}
+	}
 
-		if err := db.addRegistration("alice@example.com", "aliceaccountid", "alicetoken", []string{"Inbox", "Important"}); err != nil {
-			t.Error("Cannot addRegistration:", err)
-		}
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		t.Error("Cannot listRegistrations:", err)
+	}
+	if len(registrations) != 1 || len(registrations[0].Mailboxes) != 2 {
+		t.Error(`listRegistrations() != one registration with two mailboxes`, registrations)
 	}
+}
 
-	if true {
-		db, err := newDatabase(f.Name())
-		if err != nil {
-			t.Error("Cannot open database", err)
-		}
+func Test_sqlStore_RegistrationIsAtomic(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
 
-		if _, ok := db.Users["test@example.com"]; !ok {
-			t.Error(`Cannot find Users["test@example.com"]`)
-		}
+	// A mailbox name that does not fit makes the last step fail
+	_, err := db.conn.Exec(`CREATE TRIGGER reject_mailbox BEFORE INSERT ON xaps_mailboxes WHEN NEW.name = 'Broken'
+		BEGIN SELECT RAISE(ABORT, 'broken mailbox'); END`)
+	if err != nil {
+		t.Fatal("Cannot create trigger:", err)
+	}
 
-		if _, ok := db.Users["alice@example.com"]; !ok {
-			t.Error(`Cannot find Users["test@example.com"]`)
-		}
+	if err := db.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox", "Broken"}); err == nil {
+		t.Error("addRegistration did not report the failed mailbox")
+	}
+
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		t.Error("Cannot listRegistrations:", err)
+	}
+	if len(registrations) != 0 {
+		t.Error("addRegistration left a partial registration behind", registrations)
 	}
 }
 
-func Test_findRegistrations(t *testing.T) {
-	db, err := newDatabase("testdata/database.json")
+func Test_sqlStore_ExpireRegistrations(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	if err := db.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	if err := db.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	// New registrations get the current time from xapsd
+	list, err := db.listRegistrations()
+	if err != nil || len(list) != 2 || time.Since(list[0].Created) > time.Minute || time.Since(list[0].LastRegistered) > time.Minute {
+		t.Error(`listRegistrations() != two registrations created just now`, list, err)
+	}
+
+	if _, err := db.conn.Exec(`UPDATE xaps_registrations SET created_at = '2000-01-01 00:00:00', last_registered_at = '2000-01-01 00:00:00'`); err != nil {
+		t.Fatal("Cannot age registrations:", err)
+	}
+
+	// Registering again refreshes the registration
+	if err := db.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+
+	expired, err := db.expireRegistrations(time.Now().Add(-24 * time.Hour))
 	if err != nil {
-		t.Error("Cannot open database testdata/database.json", err)
+		t.Error("Cannot expireRegistrations:", err)
+	}
+	if len(expired) != 1 || expired[0].AccountId != "testaccountid1" || expired[0].LastRegistered.Year() != 2000 {
+		t.Error(`expireRegistrations() != [testaccountid1]`, expired)
 	}
 
-	if true {
-		registrations, err := db.findRegistrations("stefan", "Inbox")
-		if err != nil {
-			t.Error("Cannot findRegistrations:", err)
-		}
+	list, err = db.listRegistrations()
+	if err != nil {
+		t.Error("Cannot listRegistrations:", err)
+	}
+	if len(list) != 1 || list[0].AccountId != "testaccountid2" || time.Since(list[0].LastRegistered) > time.Hour || list[0].Created.Year() != 2000 {
+		t.Error(`listRegistrations() != [testaccountid2] registered just now`, list)
+	}
+}
 
-		if len(registrations) != 2 {
-			t.Error(`len(registrations) != 2`)
+func Test_sqlTime_Scan(t *testing.T) {
+	expected := time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC)
+	for _, value := range []interface{}{expected, []byte("2020-05-17 12:30:00"), "2020-05-17T12:30:00Z", "2020-05-17 14:30:00+02:00"} {
+		var scanned sqlTime
+		if err := scanned.Scan(value); err != nil || !scanned.Equal(expected) {
+			t.Error("Cannot scan", value, scanned, err)
 		}
 	}
 
-	if true {
-		registrations, err := db.findRegistrations("stefan", "Ham")
-		if err != nil {
-			t.Error("Cannot findRegistrations:", err)
-		}
+	var scanned sqlTime
+	if err := scanned.Scan(nil); err != nil || !scanned.IsZero() {
+		t.Error("Scan(nil) is not the zero time", scanned, err)
+	}
+	if err := scanned.Scan("yesterday"); err == nil {
+		t.Error(`Scan("yesterday") did not fail`)
+	}
+}
 
-		if len(registrations) != 1 {
-			t.Error(`len(registrations) != 1`)
-		}
+func Test_sqlStore_Replica(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	// The replica is the same database, under another connection
+	if err := db.connectReplica(sqliteDSN(), standaloneQueries); err != nil {
+		t.Fatal("Cannot connect replica:", err)
+	}
+	if _, ok := db.replicaQueries["select_mbx_id"]; ok {
+		t.Error("select_mbx_id was prepared on the replica")
 	}
 
-	if true {
-		registrations, err := db.findRegistrations("doesnotexist", "Inbox")
-		if err != nil {
-			t.Error("Cannot findRegistrations:", err)
-		}
+	if err := db.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	if registrations, err := db.findRegistrations("test@example.com", "Inbox"); err != nil || len(registrations) != 1 {
+		t.Error(`len(findRegistrations("Inbox")) != 1 on the replica`, registrations, err)
+	}
+	if len(db.status()) != 4 {
+		t.Error("status() does not include the replica", db.status())
+	}
 
-		if len(registrations) != 0 {
-			t.Error(`len(registrations) != 0`)
-		}
+	// Lookups go to the primary if the replica fails
+	db.replica.Close()
+	if registrations, err := db.findRegistrations("test@example.com", "Inbox"); err != nil || len(registrations) != 1 {
+		t.Error(`len(findRegistrations("Inbox")) != 1 without the replica`, registrations, err)
+	}
+	if list, err := db.listRegistrations(); err != nil || len(list) != 1 || len(list[0].Mailboxes) != 1 {
+		t.Error(`listRegistrations() != one registration without the replica`, list, err)
 	}
 }
 
-func Test_Account_ContainsMailbox(t *testing.T) {
-	account := Account{DeviceToken: "SomeToken", Mailboxes: []string{"Inbox", "Ham"}}
+func Test_sqlStore_ReplicaReconnect(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
 
-	if account.ContainsMailbox("Inbox") != true {
-		t.Error(`account.ContainsMailbox("Inbox") != true`)
+	// A replica that could not be connected at startup is connected
+	// by the next health check
+	db.replicaDSN, db.replicaSQL = sqliteDSN(), standaloneQueries
+	if err := db.ping(); err != nil {
+		t.Fatal("Cannot ping:", err)
+	}
+	if _, ok := db.replicaQueries["find_registration"]; !ok || db.replica == nil {
+		t.Error("ping did not connect the replica")
 	}
+}
 
-	if account.ContainsMailbox("Ham") != true {
-		t.Error(`account.ContainsMailbox("Ham") != true`)
+func Test_connectDatabase_ReplicaNotSupported(t *testing.T) {
+	_, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	defer func(replica string) { Config.DB.Replica = replica }(Config.DB.Replica)
+	Config.DB.Replica = sqliteDSN()
+
+	if db, err := connectDatabase(sqliteDialect); err == nil {
+		db.close()
+		t.Error("The sqlite driver accepted a read replica")
+	}
+}
+
+func Test_connectDatabase_SeveralIdentities(t *testing.T) {
+	_, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	defer func(identities map[string]IdentityConfig) { Config.Identities = identities }(Config.Identities)
+	Config.Identities = map[string]IdentityConfig{
+		"mail":     {Certificate: "mail.pem", Subtopics: []string{"com.apple.mobilemail"}},
+		"calendar": {Certificate: "calendar.pem", Subtopics: []string{"com.apple.calendar"}},
 	}
 
-	if account.ContainsMailbox("Cheese") != false {
-		t.Error(`account.ContainsMailbox("Cheese") != false`)
+	db, err := connectDatabase(sqliteDialect)
+	if err != nil {
+		t.Fatal("connectDatabase rejected the standalone preset with several identities:", err)
+	}
+	db.close()
+
+	defer func(queries map[string]SQLQueries) { Config.DB.Queries = queries }(Config.DB.Queries)
+	Config.DB.Queries = map[string]SQLQueries{
+		"find_registration": {`SELECT r.id, r.account_id, r.device_token FROM xaps_registrations r
+			JOIN xaps_mailboxes m ON m.registration_id = r.id
+			JOIN xaps_users u ON u.id = r.user_id
+			WHERE m.name = ? AND u.local_part = ? AND u.domain = ?`},
+	}
+
+	if db, err := connectDatabase(sqliteDialect); err == nil {
+		db.close()
+		t.Error("connectDatabase accepted a find_registration query without subtopic for several identities")
+	} else if !strings.Contains(err.Error(), "does not return the subtopic") {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+//
+// Without touch_aps a REGISTER does not refresh a device, so expiring
+// registrations would remove every device.
+//
+
+func Test_connectDatabase_ExpireAfter(t *testing.T) {
+	_, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	defer func(expireAfter string) { Config.Storage.ExpireAfter = expireAfter }(Config.Storage.ExpireAfter)
+	Config.Storage.ExpireAfter = "720h"
+
+	dialect := *sqliteDialect
+	dialect.queries = withQueries(standaloneQueries, nil)
+	delete(dialect.queries, "touch_aps")
+
+	if db, err := connectDatabase(&dialect); err == nil {
+		db.close()
+		t.Error("connectDatabase accepted ExpireAfter without a touch_aps query")
+	} else if !strings.Contains(err.Error(), "'touch_aps' is missing") {
+		t.Error("Unexpected error:", err)
+	}
+
+	Config.Storage.ExpireAfter = ""
+	db, err := connectDatabase(&dialect)
+	if err != nil {
+		t.Fatal("connectDatabase rejected queries without touch_aps:", err)
 	}
+	db.close()
 }
@@ -0,0 +1,167 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+//
+// A device has one token per app, so a phone with several mail
+// accounts registers the same token once for every account. That is
+// not a duplicate. Two registrations of a token conflict when they
+// are for the same user under another account id, which happens when
+// an account is renamed on the phone, or for the same account id
+// under another user, which happens when a user is renamed on the
+// server. Only the most recent of conflicting registrations is still
+// in use.
+//
+
+func conflicting(a, b Registration) bool {
+	if a.DeviceToken != b.DeviceToken {
+		return false
+	}
+	return (a.Username == b.Username) != (a.AccountId == b.AccountId)
+}
+
+const (
+	duplicateTokensKeep   = "keep"
+	duplicateTokensLatest = "latest"
+)
+
+//
+// A dedupingStore resolves token conflicts on REGISTER with the
+// "latest" policy: the new registration replaces the registrations it
+// conflicts with.
+//
+
+type dedupingStore struct {
+	registrationStore
+}
+
+func (s *dedupingStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	if err := s.registrationStore.addRegistration(username, accountId, deviceToken, subtopic, mailboxes); err != nil {
+		return err
+	}
+
+	// The registration is stored, so REGISTER succeeds even if the
+	// registrations it replaces cannot be removed
+	registrations, err := s.findTokenRegistrations(deviceToken)
+	if err != nil {
+		log.Println("Cannot look up duplicate device tokens: ", err)
+		return nil
+	}
+
+	latest := Registration{Username: username, AccountId: accountId, DeviceToken: deviceToken}
+	for _, reg := range registrations {
+		if !conflicting(latest, reg) {
+			continue
+		}
+		if err := s.deleteRegistration(reg); err != nil {
+			log.Printf("Cannot remove registration of device %s for %s/%s, it registered again as %s/%s: %v", auditPrefix(deviceToken), reg.Username, auditPrefix(reg.AccountId), username, auditPrefix(accountId), err)
+			continue
+		}
+		recordAudit(auditRemoved, reg, "replaced by "+username+"/"+auditPrefix(accountId))
+		log.Printf("Removed registration of device %s for %s/%s, it registered again as %s/%s", auditPrefix(deviceToken), reg.Username, auditPrefix(reg.AccountId), username, auditPrefix(accountId))
+	}
+
+	return nil
+}
+
+//
+// Group the registrations that share a device token with another
+// registration by token.
+//
+
+func duplicateTokens(registrations []Registration) [][]Registration {
+	byToken := make(map[string][]Registration)
+	for _, reg := range registrations {
+		byToken[reg.DeviceToken] = append(byToken[reg.DeviceToken], reg)
+	}
+
+	tokens := make([]string, 0, len(byToken))
+	for token, regs := range byToken {
+		if len(regs) > 1 {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Strings(tokens)
+
+	duplicates := make([][]Registration, 0, len(tokens))
+	for _, token := range tokens {
+		duplicates = append(duplicates, byToken[token])
+	}
+	return duplicates
+}
+
+//
+// Report the device tokens that are registered more than once. A
+// registration is stale if a more recent registration of the same token
+// conflicts with it; the "latest" policy would have removed it.
+//
+
+func runDuplicates(config string, args []string) error {
+	if len(args) != 0 {
+		return usageError("duplicates")
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		return err
+	}
+
+	duplicates := duplicateTokens(registrations)
+	stale := 0
+	for _, regs := range duplicates {
+		fmt.Printf("Device token %s:\n", regs[0].DeviceToken)
+		for _, reg := range regs {
+			state := ""
+			for _, other := range regs {
+				if conflicting(reg, other) && other.LastRegistered.After(reg.LastRegistered) {
+					state = " (stale)"
+					stale++
+					break
+				}
+			}
+			fmt.Printf("  %s/%s last registered %s%s\n", reg.Username, reg.AccountId, reg.LastRegistered.UTC().Format(time.RFC3339), state)
+		}
+	}
+
+	fmt.Printf("%d device tokens are registered more than once, %d registrations are stale\n", len(duplicates), stale)
+	return nil
+}
@@ -0,0 +1,139 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_conflicting(t *testing.T) {
+	reg := Registration{Username: "stefan", AccountId: "account1", DeviceToken: "token1"}
+
+	tests := []struct {
+		other       Registration
+		conflicting bool
+	}{
+		{Registration{Username: "stefan", AccountId: "account1", DeviceToken: "token1"}, false},
+		{Registration{Username: "stefan", AccountId: "account2", DeviceToken: "token1"}, true},
+		{Registration{Username: "alice", AccountId: "account1", DeviceToken: "token1"}, true},
+		{Registration{Username: "alice", AccountId: "account2", DeviceToken: "token1"}, false},
+		{Registration{Username: "stefan", AccountId: "account2", DeviceToken: "token2"}, false},
+	}
+	for _, test := range tests {
+		if conflicting(reg, test.other) != test.conflicting {
+			t.Errorf("conflicting(%v, %v) != %v", reg, test.other, test.conflicting)
+		}
+	}
+}
+
+func Test_dedupingStore(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "dedup_test_Test_dedupingStore")
+	if err != nil {
+		t.Fatal("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	file, err := newDatabase(f.Name())
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	sqlite, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	for _, db := range []registrationStore{file, sqlite} {
+		store := &dedupingStore{db}
+		register := func(username, accountId string) {
+			if err := store.addRegistration(username, accountId, "token1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+				t.Fatalf("%T cannot addRegistration: %v", db, err)
+			}
+		}
+
+		// A phone with accounts of two users
+		register("stefan@example.com", "account1")
+		register("alice@example.com", "account2")
+
+		// The account of stefan is renamed on the phone
+		register("stefan@example.com", "account3")
+
+		// The user alice is renamed on the server
+		register("alice.smith@example.com", "account2")
+
+		registrations, err := store.findTokenRegistrations("token1")
+		if err != nil {
+			t.Fatal("Cannot findTokenRegistrations:", err)
+		}
+		if len(registrations) != 2 {
+			t.Errorf("%T kept conflicting registrations: %v", db, registrations)
+		}
+		for _, reg := range registrations {
+			if reg.AccountId != "account3" && reg.Username != "alice.smith@example.com" {
+				t.Errorf("%T kept the wrong registration: %v", db, reg)
+			}
+		}
+	}
+}
+
+type undeletableStore struct {
+	registrationStore
+}
+
+func (s *undeletableStore) deleteRegistration(reg Registration) error {
+	return errors.New("Cannot delete")
+}
+
+func Test_dedupingStore_DeleteFails(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	store := &dedupingStore{&undeletableStore{db}}
+	if err := store.addRegistration("stefan@example.com", "account1", "token1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+
+	// The new registration is stored, so REGISTER succeeds
+	if err := store.addRegistration("stefan@example.com", "account2", "token1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("addRegistration failed because a duplicate could not be removed:", err)
+	}
+	if registrations, err := db.findTokenRegistrations("token1"); err != nil || len(registrations) != 2 {
+		t.Error("len(findTokenRegistrations()) != 2", registrations, err)
+	}
+}
+
+func Test_duplicateTokens(t *testing.T) {
+	duplicates := duplicateTokens([]Registration{
+		{Username: "stefan", AccountId: "account1", DeviceToken: "token2"},
+		{Username: "stefan", AccountId: "account2", DeviceToken: "token1"},
+		{Username: "alice", AccountId: "account3", DeviceToken: "token2"},
+		{Username: "alice", AccountId: "account4", DeviceToken: "token3"},
+	})
+
+	if len(duplicates) != 1 || len(duplicates[0]) != 2 || duplicates[0][0].DeviceToken != "token2" {
+		t.Error("duplicateTokens() != [[token2 token2]]", duplicates)
+	}
+}
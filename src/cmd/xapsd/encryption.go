@@ -0,0 +1,457 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+//
+// Device tokens and account ids can be encrypted before they are
+// stored, so that a copy of the database is not enough to send pushes
+// to the devices of users. This is envelope encryption: every
+// registration is encrypted with its own random data key, and the data
+// key is encrypted with a key derived from the key file. Both use
+// AES-GCM with random nonces, so equal values never encrypt to the
+// same ciphertext. The result is kept in the Sealed field of the
+// registration.
+//
+// The stores look registrations up by account id and device token, so
+// those are replaced by an HMAC of the value, the lookup hash. Lookup
+// hashes are deterministic: they show which registrations share a
+// device token or account id, but not the values themselves.
+//
+// Values without the lookup prefix are plaintext from before
+// encryption was enabled and are returned as they are.
+//
+
+const (
+	lookupPrefix = "xaps-hmac1:"
+	sealedPrefix = "xaps-env1:"
+)
+
+type tokenCipher struct {
+	keyEncryption cipher.AEAD
+	lookupKey     []byte
+}
+
+//
+// The key file holds at least 32 random bytes, hex or base64 encoded,
+// for example from "openssl rand -base64 32".
+//
+
+func readEncryptionKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read encryption key: %v", err)
+	}
+
+	text := strings.TrimSpace(string(data))
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(text); err != nil {
+			return nil, fmt.Errorf("Encryption key in %s is not hex or base64 encoded", path)
+		}
+	}
+	if len(key) < 32 {
+		return nil, fmt.Errorf("Encryption key in %s is %d bytes, it must be at least 32 bytes", path, len(key))
+	}
+	return key, nil
+}
+
+func newTokenCipher(key []byte) (*tokenCipher, error) {
+	keyEncryption, err := newGCM(deriveKey(key, "xapsd key encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &tokenCipher{keyEncryption: keyEncryption, lookupKey: deriveKey(key, "xapsd lookup")}, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *tokenCipher) lookup(value string) string {
+	mac := hmac.New(sha256.New, c.lookupKey)
+	mac.Write([]byte(value))
+	return lookupPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func isLookupHash(value string) bool {
+	return strings.HasPrefix(value, lookupPrefix)
+}
+
+//
+// Encrypt an account id and device token. The result looks like
+// xaps-env1:<encrypted data key>.<encrypted values>, both base64 with
+// the nonce in front.
+//
+
+func (c *tokenCipher) seal(accountId, deviceToken string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := json.Marshal([]string{accountId, deviceToken})
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := sealWithRandomNonce(c.keyEncryption, dataKey)
+	if err != nil {
+		return "", err
+	}
+	values, err := sealWithRandomNonce(data, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(wrappedKey) + "." + base64.RawURLEncoding.EncodeToString(values), nil
+}
+
+func (c *tokenCipher) unseal(sealed string) (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(sealed, sealedPrefix), ".")
+	if !strings.HasPrefix(sealed, sealedPrefix) || len(parts) != 2 {
+		return "", "", errors.New("Cannot decrypt registration: invalid encoding")
+	}
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", errors.New("Cannot decrypt registration: invalid encoding")
+	}
+	values, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", errors.New("Cannot decrypt registration: invalid encoding")
+	}
+
+	dataKey, err := openWithNonce(c.keyEncryption, wrappedKey)
+	if err != nil {
+		return "", "", fmt.Errorf("Cannot decrypt registration, is this the right key? %v", err)
+	}
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return "", "", fmt.Errorf("Cannot decrypt registration: %v", err)
+	}
+	plaintext, err := openWithNonce(data, values)
+	if err != nil {
+		return "", "", fmt.Errorf("Cannot decrypt registration: %v", err)
+	}
+
+	var decoded []string
+	if err := json.Unmarshal(plaintext, &decoded); err != nil || len(decoded) != 2 {
+		return "", "", errors.New("Cannot decrypt registration: invalid values")
+	}
+	return decoded[0], decoded[1], nil
+}
+
+func sealWithRandomNonce(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openWithNonce(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+func (c *tokenCipher) encryptRegistration(reg Registration) (Registration, error) {
+	sealed, err := c.seal(reg.AccountId, reg.DeviceToken)
+	if err != nil {
+		return reg, fmt.Errorf("Cannot encrypt registration: %v", err)
+	}
+	reg.Sealed = sealed
+	reg.AccountId = c.lookup(reg.AccountId)
+	reg.DeviceToken = c.lookup(reg.DeviceToken)
+	return reg, nil
+}
+
+//
+// Decrypt registrations. The decrypted values must match the lookup
+// hashes, so that encrypted values cannot be moved to another
+// registration.
+//
+
+func (c *tokenCipher) decryptRegistrations(registrations []Registration, err error) ([]Registration, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i := range registrations {
+		reg := &registrations[i]
+		if reg.Sealed == "" {
+			if isLookupHash(reg.AccountId) || isLookupHash(reg.DeviceToken) {
+				return nil, fmt.Errorf("Cannot decrypt registration of %s: the encrypted values are missing", reg.Username)
+			}
+			continue
+		}
+
+		accountId, deviceToken, err := c.unseal(reg.Sealed)
+		if err != nil {
+			return nil, err
+		}
+		if c.lookup(accountId) != reg.AccountId || c.lookup(deviceToken) != reg.DeviceToken {
+			return nil, fmt.Errorf("Cannot decrypt registration of %s: the encrypted values belong to another registration", reg.Username)
+		}
+		reg.AccountId, reg.DeviceToken, reg.Sealed = accountId, deviceToken, ""
+	}
+	return registrations, nil
+}
+
+//
+// An encryptingStore encrypts the account ids and device tokens that
+// go into the store it wraps, and decrypts the ones that come out.
+// Registrations are stored with importRegistration, which takes the
+// encrypted values; zero times are set like addRegistration does.
+//
+
+type encryptingStore struct {
+	registrationStore
+	cipher *tokenCipher
+}
+
+func (s *encryptingStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	return s.importRegistration(Registration{Username: username, AccountId: accountId, DeviceToken: deviceToken, Subtopic: subtopic, Mailboxes: mailboxes})
+}
+
+func (s *encryptingStore) importRegistration(reg Registration) error {
+	_, err := s.register(reg)
+	return err
+}
+
+//
+// The registration that a REGISTER replaced has the same values, so
+// it does not need to be decrypted. A plaintext registration that is
+// removed was replaced as well.
+//
+
+func (s *encryptingStore) register(reg Registration) (*Registration, error) {
+	encrypted, err := s.cipher.encryptRegistration(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous *Registration
+	if registering, ok := s.registrationStore.(registeringStore); ok {
+		previous, err = registering.register(encrypted)
+	} else {
+		err = s.registrationStore.importRegistration(encrypted)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if previous == nil {
+		previous = s.removePlaintext(reg)
+	}
+	if previous != nil {
+		previous.AccountId, previous.DeviceToken, previous.Sealed = reg.AccountId, reg.DeviceToken, ""
+	}
+	return previous, nil
+}
+
+//
+// Remove the plaintext form of a registration that was stored before
+// encryption was enabled, so that the device does not get every push
+// twice. The encrypted registration is stored already, so a failure is
+// only logged; the encrypt subcommand removes what is left.
+//
+
+func (s *encryptingStore) removePlaintext(reg Registration) *Registration {
+	registrations, err := s.registrationStore.findTokenRegistrations(reg.DeviceToken)
+	if err != nil {
+		log.Println("Cannot look up the plaintext registration: ", err)
+		return nil
+	}
+	var removed *Registration
+	for i, plaintext := range registrations {
+		if plaintext.Sealed != "" || plaintext.Username != reg.Username || plaintext.AccountId != reg.AccountId {
+			continue
+		}
+		if err := s.registrationStore.deleteRegistration(plaintext); err != nil {
+			log.Printf("Cannot remove the plaintext registration of %s: %v", reg.Username, err)
+			continue
+		}
+		removed = &registrations[i]
+	}
+	return removed
+}
+
+func (s *encryptingStore) findRegistrations(username, mailbox string) ([]Registration, error) {
+	return s.cipher.decryptRegistrations(s.registrationStore.findRegistrations(username, mailbox))
+}
+
+//
+// Find the registrations of a device token in both forms, so that
+// plaintext registrations are found until they are encrypted.
+//
+
+func (s *encryptingStore) findTokenRegistrations(deviceToken string) ([]Registration, error) {
+	encrypted, err := s.registrationStore.findTokenRegistrations(s.cipher.lookup(deviceToken))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.registrationStore.findTokenRegistrations(deviceToken)
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher.decryptRegistrations(append(encrypted, plaintext...), nil)
+}
+
+func (s *encryptingStore) userRegistrations(username string) ([]Registration, error) {
+	return s.cipher.decryptRegistrations(s.registrationStore.userRegistrations(username))
+}
+
+func (s *encryptingStore) patternRegistrations(username string) ([]Registration, error) {
+	return s.cipher.decryptRegistrations(s.registrationStore.patternRegistrations(username))
+}
+
+//
+// The registration may have been stored before encryption was enabled.
+// The file store finds registrations by their values, so delete both
+// forms; deleting a registration that does not exist does nothing.
+//
+
+func (s *encryptingStore) deleteRegistration(reg Registration) error {
+	encrypted := reg
+	encrypted.AccountId = s.cipher.lookup(reg.AccountId)
+	encrypted.DeviceToken = s.cipher.lookup(reg.DeviceToken)
+	if err := s.registrationStore.deleteRegistration(encrypted); err != nil {
+		return err
+	}
+	return s.registrationStore.deleteRegistration(reg)
+}
+
+func (s *encryptingStore) listRegistrations() ([]Registration, error) {
+	return s.cipher.decryptRegistrations(s.registrationStore.listRegistrations())
+}
+
+func (s *encryptingStore) expireRegistrations(before time.Time) ([]Registration, error) {
+	return s.cipher.decryptRegistrations(s.registrationStore.expireRegistrations(before))
+}
+
+func (s *encryptingStore) ping() error {
+	if p, ok := s.registrationStore.(pinger); ok {
+		return p.ping()
+	}
+	return nil
+}
+
+//
+// Encrypt the registrations that were stored before encryption was
+// enabled. Each one is stored again in encrypted form, with its times,
+// and then the plaintext registration is deleted.
+//
+
+func runEncrypt(config string, args []string) error {
+	if len(args) != 0 {
+		return usageError("encrypt")
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+	if Config.Storage.EncryptionKeyFile == "" {
+		return fmt.Errorf("There is no EncryptionKeyFile in the configuration")
+	}
+
+	key, err := readEncryptionKey(Config.Storage.EncryptionKeyFile)
+	if err != nil {
+		return err
+	}
+	c, err := newTokenCipher(key)
+	if err != nil {
+		return err
+	}
+
+	open, ok := storageDrivers[Config.Storage.Driver]
+	if !ok {
+		return fmt.Errorf("Unknown storage driver '%s'", Config.Storage.Driver)
+	}
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	encrypted, err := encryptRegistrations(db, c)
+	fmt.Printf("Encrypted %d registrations\n", encrypted)
+	return err
+}
+
+func encryptRegistrations(db registrationStore, c *tokenCipher) (int, error) {
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		return 0, err
+	}
+
+	encrypted := 0
+	for _, reg := range registrations {
+		if reg.Sealed != "" {
+			continue
+		}
+		sealed, err := c.encryptRegistration(reg)
+		if err != nil {
+			return encrypted, err
+		}
+		if err := db.importRegistration(sealed); err != nil {
+			return encrypted, fmt.Errorf("Cannot encrypt %s/%s: %v", reg.Username, reg.AccountId, err)
+		}
+		if err := db.deleteRegistration(reg); err != nil {
+			return encrypted, fmt.Errorf("Cannot delete plaintext %s/%s: %v", reg.Username, reg.AccountId, err)
+		}
+		encrypted++
+	}
+	return encrypted, nil
+}
@@ -0,0 +1,256 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestCipher(t *testing.T) *tokenCipher {
+	c, err := newTokenCipher([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal("Cannot create cipher:", err)
+	}
+	return c
+}
+
+func Test_tokenCipher(t *testing.T) {
+	c := newTestCipher(t)
+
+	reg, err := c.encryptRegistration(Registration{Username: "test@example.com", AccountId: "testaccountid", DeviceToken: "testtoken"})
+	if err != nil {
+		t.Fatal("Cannot encryptRegistration:", err)
+	}
+	if !isLookupHash(reg.AccountId) || !isLookupHash(reg.DeviceToken) || strings.Contains(reg.Sealed, "testtoken") {
+		t.Error("encryptRegistration() did not encrypt:", reg)
+	}
+	if reg.DeviceToken != c.lookup("testtoken") || c.lookup("testtoken2") == reg.DeviceToken {
+		t.Error("Lookup hashes are not deterministic:", reg.DeviceToken)
+	}
+	again, _ := c.encryptRegistration(Registration{AccountId: "testaccountid", DeviceToken: "testtoken"})
+	if again.Sealed == reg.Sealed {
+		t.Error("encryptRegistration() encrypted the same values to the same ciphertext")
+	}
+
+	decrypted, err := c.decryptRegistrations([]Registration{reg, {AccountId: "plainaccountid", DeviceToken: "plaintoken"}}, nil)
+	if err != nil || decrypted[0].AccountId != "testaccountid" || decrypted[0].DeviceToken != "testtoken" || decrypted[0].Sealed != "" {
+		t.Error("decryptRegistrations() =", decrypted, err)
+	}
+	if err == nil && (decrypted[1].AccountId != "plainaccountid" || decrypted[1].DeviceToken != "plaintoken") {
+		t.Error("decryptRegistrations() of plaintext =", decrypted[1])
+	}
+
+	other, _ := newTokenCipher([]byte("fedcba9876543210fedcba9876543210"))
+	if _, err := other.decryptRegistrations([]Registration{reg}, nil); err == nil {
+		t.Error("decryptRegistrations() with another key did not fail")
+	}
+	modified := reg
+	modified.Sealed = reg.Sealed[:len(reg.Sealed)-2] + "AA"
+	if _, err := c.decryptRegistrations([]Registration{modified}, nil); err == nil {
+		t.Error("decryptRegistrations() of a modified value did not fail")
+	}
+	moved := reg
+	moved.Sealed = again.Sealed
+	moved.DeviceToken = c.lookup("othertoken")
+	if _, err := c.decryptRegistrations([]Registration{moved}, nil); err == nil {
+		t.Error("decryptRegistrations() accepted values of another registration")
+	}
+	missing := reg
+	missing.Sealed = ""
+	if _, err := c.decryptRegistrations([]Registration{missing}, nil); err == nil {
+		t.Error("decryptRegistrations() accepted lookup hashes without values")
+	}
+}
+
+func Test_readEncryptionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption_test")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	for _, encoded := range []string{"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n", "3031323334353637383961626364656630313233343536373839616263646566"} {
+		ioutil.WriteFile(path, []byte(encoded), 0600)
+		if key, err := readEncryptionKey(path); err != nil || string(key) != "0123456789abcdef0123456789abcdef" {
+			t.Error("readEncryptionKey() =", key, err)
+		}
+	}
+
+	ioutil.WriteFile(path, []byte("c2hvcnQ="), 0600)
+	if _, err := readEncryptionKey(path); err == nil {
+		t.Error("readEncryptionKey() accepted a short key")
+	}
+}
+
+func Test_encryptingStore(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	c := newTestCipher(t)
+
+	// Stored before encryption was enabled
+	for _, id := range []string{"1", "3"} {
+		if err := db.addRegistration("test@example.com", "testaccountid"+id, "testtoken"+id, "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+			t.Fatal("Cannot addRegistration:", err)
+		}
+	}
+
+	store := &encryptingStore{db, c}
+	if err := store.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+	// Registering again finds the encrypted registration
+	if err := store.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+	// A device that registered before encryption was enabled replaces
+	// its plaintext registration
+	if err := store.addRegistration("test@example.com", "testaccountid3", "testtoken3", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+
+	var plaintext int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM xaps_registrations WHERE sealed = ''`).Scan(&plaintext); err != nil || plaintext != 1 {
+		t.Error("Plaintext registrations:", plaintext, err)
+	}
+	var stored, sealed string
+	if err := db.conn.QueryRow(`SELECT device_token, sealed FROM xaps_registrations WHERE account_id = ?`, c.lookup("testaccountid2")).Scan(&stored, &sealed); err != nil {
+		t.Fatal("Cannot find the encrypted registration:", err)
+	}
+	if stored != c.lookup("testtoken2") || strings.Contains(sealed, "testtoken2") || sealed == "" {
+		t.Error("Device token is stored as", stored, sealed)
+	}
+
+	registrations, err := store.findRegistrations("test@example.com", "Inbox")
+	if err != nil || len(registrations) != 3 {
+		t.Fatal(`len(findRegistrations("Inbox")) != 3`, registrations, err)
+	}
+	for _, reg := range registrations {
+		if isLookupHash(reg.DeviceToken) || isLookupHash(reg.AccountId) || reg.Sealed != "" {
+			t.Error("findRegistrations returned an encrypted registration", reg)
+		}
+	}
+
+	if found, err := store.findTokenRegistrations("testtoken2"); err != nil || len(found) != 1 || found[0].DeviceToken != "testtoken2" {
+		t.Error(`findTokenRegistrations("testtoken2") =`, found, err)
+	}
+	if found, err := store.findTokenRegistrations("testtoken1"); err != nil || len(found) != 1 || found[0].DeviceToken != "testtoken1" {
+		t.Error(`findTokenRegistrations("testtoken1") =`, found, err)
+	}
+
+	// Encrypt the plaintext registration
+	if n, err := encryptRegistrations(db, c); err != nil || n != 1 {
+		t.Error("encryptRegistrations() =", n, err)
+	}
+	list, err := db.listRegistrations()
+	if err != nil || len(list) != 3 {
+		t.Fatal("Cannot listRegistrations:", list, err)
+	}
+	for _, reg := range list {
+		if !isLookupHash(reg.DeviceToken) || !isLookupHash(reg.AccountId) || reg.Sealed == "" || len(reg.Mailboxes) != 1 {
+			t.Error("Registration was not encrypted", reg)
+		}
+	}
+
+	registrations, err = store.findRegistrations("test@example.com", "Inbox")
+	if err != nil || len(registrations) != 3 {
+		t.Fatal(`len(findRegistrations("Inbox")) != 3`, registrations, err)
+	}
+	if err := store.deleteRegistration(registrations[0]); err != nil {
+		t.Error("Cannot deleteRegistration:", err)
+	}
+	if list, _ := store.listRegistrations(); len(list) != 2 {
+		t.Error("deleteRegistration did not delete", list)
+	}
+}
+
+func Test_checkEncryptionQueries(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	// A find_registration query from before encryption
+	old := `SELECT r.id, r.account_id, r.device_token, r.subtopic FROM xaps_registrations r WHERE 0 = ? AND 0 = ? AND 0 = ?`
+	queries := withQueries(standaloneQueries, map[string]string{"find_registration": old})
+	delete(queries, "set_aps_sealed")
+	stmt, err := db.conn.Prepare(old)
+	if err != nil {
+		t.Fatal("Cannot prepare query:", err)
+	}
+	db.queries["find_registration"] = stmt
+	delete(db.queries, "set_aps_sealed")
+
+	problems := checkEncryptionQueries(db, queries)
+	if len(problems) != 2 || !strings.Contains(problems[0], "set_aps_sealed") || !strings.Contains(problems[1], "find_registration") {
+		t.Error("checkEncryptionQueries() =", problems)
+	}
+	if problems := checkEncryptionQueries(db, standaloneQueries); len(problems) != 1 {
+		t.Error("checkEncryptionQueries() of the changed find_registration =", problems)
+	}
+}
+
+func Test_encryptingStore_File(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "encryption_test_Test_encryptingStore_File")
+	if err != nil {
+		t.Fatal("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	db, err := newDatabase(f.Name())
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+
+	// Stored before encryption was enabled
+	if err := db.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+
+	store := &encryptingStore{db, newTestCipher(t)}
+	if err := store.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+
+	data, _ := ioutil.ReadFile(f.Name())
+	if strings.Contains(string(data), "testtoken") || strings.Contains(string(data), "testaccountid") {
+		t.Error("The file contains the plaintext token or account id")
+	}
+
+	registrations, err := store.findRegistrations("test@example.com", "Inbox")
+	if err != nil || len(registrations) != 1 {
+		t.Fatal(`len(findRegistrations("Inbox")) != 1`, registrations, err)
+	}
+	if err := store.deleteRegistration(registrations[0]); err != nil {
+		t.Error("Cannot deleteRegistration:", err)
+	}
+	if list, _ := store.listRegistrations(); len(list) != 0 {
+		t.Error("deleteRegistration did not delete", list)
+	}
+}
@@ -0,0 +1,449 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+// The file storage driver keeps all registrations in a single JSON
+// file, for installations that do not want to run a database server
+// just for push. The file looks like this:
+//
+//  { "Users": { "stefan": { "Accounts": { "<aps-account-id>": {
+//      "DeviceToken": "<aps-device-token>",
+//      "Mailboxes": ["Inbox", "Notes"] } } } } }
+//
+// Changes are written to a temporary file that is renamed over the
+// database, so a crash never leaves a partially written file behind.
+// Writers hold an exclusive lock on <file>.lock so that xapsd and its
+// subcommands can safely modify the same file.
+//
+
+type Account struct {
+	DeviceToken    string
+	Mailboxes      []string
+	Subtopic       string `json:",omitempty"`
+	Sealed         string `json:",omitempty"`
+	Created        time.Time
+	LastRegistered time.Time
+}
+
+type User struct {
+	Accounts map[string]*Account
+}
+
+type Database struct {
+	filename string
+	mu       sync.Mutex
+	modTime  time.Time
+	size     int64
+	Users    map[string]*User
+}
+
+func init() {
+	registerStorageDriver("file", func() (registrationStore, error) {
+		return newDatabase(Config.Storage.File)
+	})
+}
+
+func (account *Account) ContainsMailbox(mailbox string) bool {
+	for _, m := range account.Mailboxes {
+		if m == mailbox {
+			return true
+		}
+	}
+	return false
+}
+
+func newDatabase(filename string) (*Database, error) {
+	db := &Database{filename: filename, Users: make(map[string]*User)}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+//
+// Read the file if it was changed since it was last read. A missing
+// or empty file is an empty database.
+//
+
+func (db *Database) load() error {
+	info, err := os.Stat(db.filename)
+	if os.IsNotExist(err) {
+		db.Users = make(map[string]*User)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(db.modTime) && info.Size() == db.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(db.filename)
+	if err != nil {
+		return err
+	}
+
+	users := struct{ Users map[string]*User }{}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &users); err != nil {
+			return err
+		}
+	}
+	if users.Users == nil {
+		users.Users = make(map[string]*User)
+	}
+
+	db.Users = users.Users
+	db.modTime = info.ModTime()
+	db.size = info.Size()
+
+	if *debug {
+		log.Println("[DEBUG] Loaded", len(db.Users), "users from", db.filename)
+	}
+
+	return nil
+}
+
+func (db *Database) write() error {
+	data, err := json.MarshalIndent(struct{ Users map[string]*User }{db.Users}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(db.filename), filepath.Base(db.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), db.filename); err != nil {
+		return err
+	}
+
+	// Make sure the rename itself is on disk
+	if dir, err := os.Open(filepath.Dir(db.filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	info, err := os.Stat(db.filename)
+	if err != nil {
+		return err
+	}
+	db.modTime = info.ModTime()
+	db.size = info.Size()
+
+	return nil
+}
+
+//
+// Run fn with the lock held and the latest contents of the file
+// loaded, and write the database when fn returns without error.
+//
+
+func (db *Database) update(fn func() error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	lock, err := os.OpenFile(db.filename+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if err := db.load(); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	return db.write()
+}
+
+func (db *Database) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	_, err := db.register(Registration{Username: username, AccountId: accountId, DeviceToken: deviceToken, Subtopic: subtopic, Mailboxes: mailboxes})
+	return err
+}
+
+func (db *Database) importRegistration(reg Registration) error {
+	_, err := db.register(reg)
+	return err
+}
+
+func (db *Database) register(reg Registration) (*Registration, error) {
+	var previous *Registration
+	err := db.update(func() error {
+		user, ok := db.Users[reg.Username]
+		if !ok {
+			user = &User{Accounts: make(map[string]*Account)}
+			db.Users[reg.Username] = user
+		}
+
+		// A registration with the same device token is replaced and
+		// keeps its creation time
+		old, ok := user.Accounts[reg.AccountId]
+		if ok && old.DeviceToken == reg.DeviceToken {
+			previous = &Registration{Username: reg.Username, AccountId: reg.AccountId, DeviceToken: old.DeviceToken, Subtopic: old.Subtopic, Mailboxes: old.Mailboxes}
+		}
+
+		now := time.Now().UTC()
+		account := &Account{DeviceToken: reg.DeviceToken, Mailboxes: reg.Mailboxes, Subtopic: reg.Subtopic, Sealed: reg.Sealed, Created: reg.Created.UTC(), LastRegistered: reg.LastRegistered.UTC()}
+		if reg.Created.IsZero() {
+			account.Created = now
+			if previous != nil && !old.Created.IsZero() {
+				account.Created = old.Created
+			}
+		}
+		if reg.LastRegistered.IsZero() {
+			account.LastRegistered = now
+		}
+		user.Accounts[reg.AccountId] = account
+
+		if *debug {
+			log.Println("[DEBUG] Registered Account: ", reg.Username, reg.AccountId)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+func (db *Database) findRegistrations(username, mailbox string) ([]Registration, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	var registrations []Registration
+	if user, ok := db.Users[username]; ok {
+		for accountId, account := range user.Accounts {
+			if account.ContainsMailbox(mailbox) {
+				registrations = append(registrations,
+					Registration{Username: username, AccountId: accountId, DeviceToken: account.DeviceToken, Subtopic: account.Subtopic, Sealed: account.Sealed})
+				if *debug {
+					log.Println("[DEBUG] Found Registration:", account.DeviceToken, accountId)
+				}
+			}
+		}
+	}
+
+	return registrations, nil
+}
+
+func (db *Database) findTokenRegistrations(deviceToken string) ([]Registration, error) {
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Registration
+	for _, reg := range registrations {
+		if reg.DeviceToken == deviceToken {
+			found = append(found, reg)
+		}
+	}
+	return found, nil
+}
+
+func (db *Database) userRegistrations(username string) ([]Registration, error) {
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Registration
+	for _, reg := range registrations {
+		if reg.Username == username {
+			found = append(found, reg)
+		}
+	}
+	return found, nil
+}
+
+func (db *Database) patternRegistrations(username string) ([]Registration, error) {
+	registrations, err := db.userRegistrations(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Registration
+	for _, reg := range registrations {
+		for _, mailbox := range reg.Mailboxes {
+			if isMailboxPattern(mailbox) {
+				found = append(found, reg)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+func (db *Database) deleteRegistration(reg Registration) error {
+	return db.update(func() error {
+		user, ok := db.Users[reg.Username]
+		if !ok {
+			return nil
+		}
+
+		if account, ok := user.Accounts[reg.AccountId]; ok && account.DeviceToken == reg.DeviceToken {
+			delete(user.Accounts, reg.AccountId)
+		}
+		if len(user.Accounts) == 0 {
+			delete(db.Users, reg.Username)
+		}
+
+		return nil
+	})
+}
+
+func (db *Database) listRegistrations() ([]Registration, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	usernames := make([]string, 0, len(db.Users))
+	for username := range db.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var registrations []Registration
+	for _, username := range usernames {
+		accountIds := make([]string, 0, len(db.Users[username].Accounts))
+		for accountId := range db.Users[username].Accounts {
+			accountIds = append(accountIds, accountId)
+		}
+		sort.Strings(accountIds)
+
+		for _, accountId := range accountIds {
+			account := db.Users[username].Accounts[accountId]
+			registrations = append(registrations, Registration{
+				Username:    username,
+				AccountId:   accountId,
+				DeviceToken: account.DeviceToken,
+				Subtopic:    account.Subtopic,
+				Sealed:      account.Sealed,
+				Mailboxes:   append([]string(nil), account.Mailboxes...),
+
+				Created:        account.Created,
+				LastRegistered: account.LastRegistered,
+			})
+		}
+	}
+
+	return registrations, nil
+}
+
+//
+// Accounts from files written by older versions have no registration
+// time. They get the current time, so they expire if the device does
+// not register again.
+//
+
+func (db *Database) expireRegistrations(before time.Time) ([]Registration, error) {
+	var expired []Registration
+	err := db.update(func() error {
+		now := time.Now().UTC()
+		for username, user := range db.Users {
+			for accountId, account := range user.Accounts {
+				if account.LastRegistered.IsZero() {
+					account.LastRegistered = now
+				}
+				if account.LastRegistered.Before(before) {
+					expired = append(expired, Registration{
+						Username:       username,
+						AccountId:      accountId,
+						DeviceToken:    account.DeviceToken,
+						Subtopic:       account.Subtopic,
+						Sealed:         account.Sealed,
+						Mailboxes:      account.Mailboxes,
+						Created:        account.Created,
+						LastRegistered: account.LastRegistered,
+					})
+					delete(user.Accounts, accountId)
+				}
+			}
+			if len(user.Accounts) == 0 {
+				delete(db.Users, username)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+func (db *Database) status() []statusValue {
+	return nil
+}
+
+func (db *Database) close() error {
+	return nil
+}
@@ -0,0 +1,256 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_newDatabase(t *testing.T) {
+	db, err := newDatabase("testdata/database.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database.json", err)
+	}
+
+	if db.filename != "testdata/database.json" {
+		t.Error(`db.filename != "testdata/database.json"`)
+	}
+
+	if len(db.Users) != 2 {
+		t.Error("len(db.Users) != 2")
+	}
+
+	if len(db.Users["stefan"].Accounts) != 2 {
+		t.Error(`db.Users["stefan"].Accounts) != 1`)
+	}
+
+	if len(db.Users["alice"].Accounts) != 1 {
+		t.Error(`db.Users["alice"].Accounts) != 1`)
+	}
+}
+
+func Test_addRegistration(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "database_test_Test_addRegistration")
+	if err != nil {
+		t.Error("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	if true {
+		db, err := newDatabase(f.Name())
+		if err != nil {
+			t.Error("Cannot open database", err)
+		}
+
+		if err := db.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox", "Spam"}); err != nil {
+			t.Error("Cannot addRegistration:", err)
+		}
+
+		if err := db.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox", "Ham"}); err != nil {
+			t.Error("Cannot addRegistration:", err)
+		}
+
+		if err := db.addRegistration("alice@example.com", "aliceaccountid", "alicetoken", "com.apple.mobilemail", []string{"Inbox", "Important"}); err != nil {
+			t.Error("Cannot addRegistration:", err)
+		}
+	}
+
+	if true {
+		db, err := newDatabase(f.Name())
+		if err != nil {
+			t.Error("Cannot open database", err)
+		}
+
+		if _, ok := db.Users["test@example.com"]; !ok {
+			t.Error(`Cannot find Users["test@example.com"]`)
+		}
+
+		if _, ok := db.Users["alice@example.com"]; !ok {
+			t.Error(`Cannot find Users["test@example.com"]`)
+		}
+	}
+}
+
+func Test_Database_register(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "database_test_Test_Database_register")
+	if err != nil {
+		t.Fatal("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	db, err := newDatabase(f.Name())
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+
+	reg := Registration{Username: "test@example.com", AccountId: "testaccountid", DeviceToken: "testtoken", Mailboxes: []string{"Inbox"}}
+	if previous, err := db.register(reg); err != nil || previous != nil {
+		t.Fatal("register() of a new registration =", previous, err)
+	}
+	reg.Mailboxes = []string{"Inbox", "Notes"}
+	if previous, err := db.register(reg); err != nil || previous == nil || len(previous.Mailboxes) != 1 {
+		t.Error("register() again =", previous, err)
+	}
+	reg.DeviceToken = "othertoken"
+	if previous, err := db.register(reg); err != nil || previous != nil {
+		t.Error("register() with another device token =", previous, err)
+	}
+}
+
+func Test_findRegistrations(t *testing.T) {
+	db, err := newDatabase("testdata/database.json")
+	if err != nil {
+		t.Error("Cannot open database testdata/database.json", err)
+	}
+
+	if true {
+		registrations, err := db.findRegistrations("stefan", "Inbox")
+		if err != nil {
+			t.Error("Cannot findRegistrations:", err)
+		}
+
+		if len(registrations) != 2 {
+			t.Error(`len(registrations) != 2`)
+		}
+	}
+
+	if true {
+		registrations, err := db.findRegistrations("stefan", "Ham")
+		if err != nil {
+			t.Error("Cannot findRegistrations:", err)
+		}
+
+		if len(registrations) != 1 {
+			t.Error(`len(registrations) != 1`)
+		}
+	}
+
+	if true {
+		registrations, err := db.findRegistrations("doesnotexist", "Inbox")
+		if err != nil {
+			t.Error("Cannot findRegistrations:", err)
+		}
+
+		if len(registrations) != 0 {
+			t.Error(`len(registrations) != 0`)
+		}
+	}
+}
+
+func Test_deleteRegistration(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "database_test_Test_deleteRegistration")
+	if err != nil {
+		t.Error("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	db, err := newDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+
+	if err := db.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	if err := db.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+
+	if err := db.deleteRegistration(Registration{Username: "test@example.com", AccountId: "testaccountid1", DeviceToken: "testtoken1"}); err != nil {
+		t.Error("Cannot deleteRegistration:", err)
+	}
+
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		t.Error("Cannot listRegistrations:", err)
+	}
+
+	if len(registrations) != 1 || registrations[0].AccountId != "testaccountid2" {
+		t.Error(`listRegistrations() != [testaccountid2]`, registrations)
+	}
+}
+
+func Test_expireRegistrations(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "database_test_Test_expireRegistrations")
+	if err != nil {
+		t.Error("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	db, err := newDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+
+	if err := db.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	if err := db.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	db.Users["test@example.com"].Accounts["testaccountid1"].LastRegistered = time.Now().Add(-48 * time.Hour)
+	db.Users["test@example.com"].Accounts["testaccountid2"].LastRegistered = time.Time{}
+	db.write()
+
+	expired, err := db.expireRegistrations(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Error("Cannot expireRegistrations:", err)
+	}
+	if len(expired) != 1 || expired[0].AccountId != "testaccountid1" {
+		t.Error(`expireRegistrations() != [testaccountid1]`, expired)
+	}
+
+	// Accounts without a registration time get the current time
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		t.Error("Cannot listRegistrations:", err)
+	}
+	if len(registrations) != 1 || registrations[0].LastRegistered.IsZero() {
+		t.Error(`listRegistrations() != [testaccountid2] with a registration time`, registrations)
+	}
+}
+
+func Test_Account_ContainsMailbox(t *testing.T) {
+	account := Account{DeviceToken: "SomeToken", Mailboxes: []string{"Inbox", "Ham"}}
+
+	if account.ContainsMailbox("Inbox") != true {
+		t.Error(`account.ContainsMailbox("Inbox") != true`)
+	}
+
+	if account.ContainsMailbox("Ham") != true {
+		t.Error(`account.ContainsMailbox("Ham") != true`)
+	}
+
+	if account.ContainsMailbox("Cheese") != false {
+		t.Error(`account.ContainsMailbox("Cheese") != false`)
+	}
+}
@@ -0,0 +1,326 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//
+// An unavailableError means that the storage backend cannot be reached
+// at the moment, as opposed to a problem with the request itself.
+// Dovecot can try again later.
+//
+
+type unavailableError struct {
+	err error
+}
+
+func (e unavailableError) Error() string {
+	return "Storage is unavailable: " + e.err.Error()
+}
+
+func isUnavailable(err error) bool {
+	var unavailable unavailableError
+	return errors.As(err, &unavailable)
+}
+
+//
+// Errors that mean the connection to the database is gone, as opposed
+// to errors about the request itself, like an unknown user. Drivers
+// report these in different ways; a lost connection that is not
+// recognized here is still noticed by the periodic check.
+//
+
+func isConnectionError(err error) bool {
+	var netError net.Error
+	return isUnavailable(err) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netError)
+}
+
+//
+// Stores that can check their connection implement pinger.
+//
+
+type pinger interface {
+	ping() error
+}
+
+//
+// A healthStore keeps track of whether the store it wraps can be
+// reached. If the store cannot be opened at startup, xapsd starts
+// without it and the healthStore keeps trying to open it in the
+// background, waiting longer after every failure. Once open, the
+// connection is checked periodically and after every failed
+// operation. While the store is unavailable, operations fail with an
+// unavailableError.
+//
+
+type healthStore struct {
+	open          func() (registrationStore, error)
+	checkInterval time.Duration
+	maxBackoff    time.Duration
+
+	mu        sync.RWMutex
+	store     registrationStore
+	available bool
+	lastError error
+	since     time.Time
+}
+
+//
+// Start monitoring a store. The store and err are the result of the
+// first call to open.
+//
+
+func newHealthStore(open func() (registrationStore, error), store registrationStore, err error, checkInterval, maxBackoff time.Duration) *healthStore {
+	h := &healthStore{open: open, checkInterval: checkInterval, maxBackoff: maxBackoff}
+
+	if err != nil {
+		log.Println("Starting without storage, will retry in the background: ", err)
+	}
+	h.setState(store, err)
+
+	go h.monitor()
+
+	return h
+}
+
+func (h *healthStore) monitor() {
+	backoff := time.Second
+	for {
+		h.mu.RLock()
+		available := h.available
+		h.mu.RUnlock()
+
+		if available {
+			backoff = time.Second
+			time.Sleep(h.checkInterval)
+		} else {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > h.maxBackoff {
+				backoff = h.maxBackoff
+			}
+		}
+
+		h.check()
+	}
+}
+
+//
+// Open the store if it is not open yet, otherwise ping it, and record
+// the result.
+//
+
+func (h *healthStore) check() {
+	h.mu.RLock()
+	store := h.store
+	h.mu.RUnlock()
+
+	if store == nil {
+		store, err := h.open()
+		h.setState(store, err)
+		return
+	}
+
+	var err error
+	if p, ok := store.(pinger); ok {
+		err = p.ping()
+	}
+	h.setState(store, err)
+}
+
+func (h *healthStore) setState(store registrationStore, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if store != nil && h.store == nil {
+		h.store = store
+	}
+	available := err == nil && h.store != nil
+	if available != h.available || h.since.IsZero() {
+		h.since = time.Now()
+		if available && h.lastError != nil {
+			log.Println("Storage is available again")
+		} else if !available && h.available {
+			log.Println("Storage is unavailable: ", err)
+		}
+	}
+	h.available = available
+	h.lastError = err
+}
+
+//
+// Return the store if it is available, otherwise an unavailableError.
+//
+
+func (h *healthStore) get() (registrationStore, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if !h.available {
+		return nil, unavailableError{h.lastError}
+	}
+	return h.store, nil
+}
+
+//
+// Check an error from the store. If the store can no longer be
+// reached, that is the more useful error. Only connection errors are
+// checked, so that a rejected request does not cost another round
+// trip.
+//
+
+func (h *healthStore) failed(err error) error {
+	if err == nil || !isConnectionError(err) {
+		return err
+	}
+
+	h.check()
+	if _, unavailable := h.get(); unavailable != nil {
+		return unavailable
+	}
+	return err
+}
+
+func (h *healthStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	store, err := h.get()
+	if err != nil {
+		return err
+	}
+	return h.failed(store.addRegistration(username, accountId, deviceToken, subtopic, mailboxes))
+}
+
+func (h *healthStore) importRegistration(reg Registration) error {
+	store, err := h.get()
+	if err != nil {
+		return err
+	}
+	return h.failed(store.importRegistration(reg))
+}
+
+func (h *healthStore) findRegistrations(username, mailbox string) ([]Registration, error) {
+	store, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := store.findRegistrations(username, mailbox)
+	return registrations, h.failed(err)
+}
+
+func (h *healthStore) findTokenRegistrations(deviceToken string) ([]Registration, error) {
+	store, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := store.findTokenRegistrations(deviceToken)
+	return registrations, h.failed(err)
+}
+
+func (h *healthStore) userRegistrations(username string) ([]Registration, error) {
+	store, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := store.userRegistrations(username)
+	return registrations, h.failed(err)
+}
+
+func (h *healthStore) patternRegistrations(username string) ([]Registration, error) {
+	store, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := store.patternRegistrations(username)
+	return registrations, h.failed(err)
+}
+
+func (h *healthStore) deleteRegistration(reg Registration) error {
+	store, err := h.get()
+	if err != nil {
+		return err
+	}
+	return h.failed(store.deleteRegistration(reg))
+}
+
+func (h *healthStore) listRegistrations() ([]Registration, error) {
+	store, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := store.listRegistrations()
+	return registrations, h.failed(err)
+}
+
+func (h *healthStore) expireRegistrations(before time.Time) ([]Registration, error) {
+	store, err := h.get()
+	if err != nil {
+		return nil, err
+	}
+	registrations, err := store.expireRegistrations(before)
+	return registrations, h.failed(err)
+}
+
+func (h *healthStore) status() []statusValue {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	status := []statusValue{
+		{"storage-available", strconv.FormatBool(h.available)},
+		{"storage-since", h.since.UTC().Format(time.RFC3339)},
+	}
+	if !h.available && h.lastError != nil {
+		status = append(status, statusValue{"storage-error", h.lastError.Error()})
+	}
+	if h.store != nil {
+		status = append(status, h.store.status()...)
+	}
+	return status
+}
+
+func (h *healthStore) close() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.store == nil {
+		return nil
+	}
+	return h.store.close()
+}
@@ -0,0 +1,183 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type flakyStore struct {
+	registeringStore
+	down  bool
+	pings int
+}
+
+func (s *flakyStore) ping() error {
+	s.pings++
+	if s.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (s *flakyStore) findRegistrations(username, mailbox string) ([]Registration, error) {
+	if s.down {
+		return nil, fmt.Errorf("Cannot look up registrations: %w", driver.ErrBadConn)
+	}
+	return s.registeringStore.findRegistrations(username, mailbox)
+}
+
+func Test_healthStore(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	flaky := &flakyStore{registeringStore: db}
+	opens := 0
+	open := func() (registrationStore, error) {
+		opens++
+		if opens == 1 {
+			return nil, unavailableError{errors.New("connection refused")}
+		}
+		return flaky, nil
+	}
+
+	first, err := open()
+	health := newHealthStore(open, first, err, time.Hour, time.Hour)
+
+	// Started without the store
+	if _, err := health.findRegistrations("test@example.com", "Inbox"); !isUnavailable(err) {
+		t.Error("findRegistrations did not report the store as unavailable:", err)
+	}
+	if status := formatStatus(health.status()); status[:25] != `storage-available="false"` {
+		t.Error("status() does not report the store as unavailable:", status)
+	}
+
+	health.check()
+	if _, err := health.findRegistrations("test@example.com", "Inbox"); err != nil {
+		t.Error("Cannot findRegistrations after the store was opened:", err)
+	}
+
+	// Failures are reported as unavailable if the store is down
+	flaky.down = true
+	if _, err := health.findRegistrations("test@example.com", "Inbox"); !isUnavailable(err) {
+		t.Error("findRegistrations did not report the store as unavailable:", err)
+	}
+
+	flaky.down = false
+	health.check()
+	if _, err := health.findRegistrations("test@example.com", "Inbox"); err != nil {
+		t.Error("Cannot findRegistrations after the store came back:", err)
+	}
+
+	// Other errors are passed on
+	if err := health.addRegistration("test", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+	if opens != 2 {
+		t.Error("Store was opened more than once:", opens)
+	}
+
+	// Errors about the request do not check the connection
+	_, err = db.conn.Exec(`CREATE TRIGGER reject_mailbox BEFORE INSERT ON xaps_mailboxes WHEN NEW.name = 'Broken'
+		BEGIN SELECT RAISE(ABORT, 'broken mailbox'); END`)
+	if err != nil {
+		t.Fatal("Cannot create trigger:", err)
+	}
+	flaky.pings = 0
+	if err := health.addRegistration("test", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Broken"}); err == nil || isUnavailable(err) {
+		t.Error("addRegistration did not pass on the error:", err)
+	}
+	if flaky.pings != 0 {
+		t.Error("A request error checked the connection:", flaky.pings)
+	}
+}
+
+//
+// The audit trail is wrapped around the driver, so it must pass the
+// connection checks on.
+//
+
+func Test_healthStore_Audit(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	flaky := &flakyStore{registeringStore: db}
+	open := func() (registrationStore, error) {
+		return &auditingStore{flaky}, nil
+	}
+	first, err := open()
+	health := newHealthStore(open, first, err, time.Hour, time.Hour)
+
+	flaky.down = true
+	health.check()
+	if flaky.pings != 1 {
+		t.Error("check() did not ping the store through the audit trail:", flaky.pings)
+	}
+	if status := formatStatus(health.status()); status[:25] != `storage-available="false"` {
+		t.Error("status() does not report the store as unavailable:", status)
+	}
+	if _, err := health.findRegistrations("test@example.com", "Inbox"); !isUnavailable(err) {
+		t.Error("findRegistrations did not report the store as unavailable:", err)
+	}
+
+	flaky.down = false
+	health.check()
+	if _, err := health.findRegistrations("test@example.com", "Inbox"); err != nil {
+		t.Error("Cannot findRegistrations after the store came back:", err)
+	}
+}
+
+func Test_isConnectionError(t *testing.T) {
+	if !isConnectionError(fmt.Errorf("Cannot look up user: %w", driver.ErrBadConn)) {
+		t.Error("isConnectionError does not find a wrapped driver.ErrBadConn")
+	}
+	if !isConnectionError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}) {
+		t.Error("isConnectionError does not recognize network errors")
+	}
+	if isConnectionError(errors.New("Unknown user test@example.com")) {
+		t.Error(`isConnectionError("Unknown user") is true`)
+	}
+}
+
+func Test_formatStatus(t *testing.T) {
+	status := formatStatus([]statusValue{{"version", "2.4.0"}, {"storage-error", "near \"x\": syntax error\tat\n line 1"}})
+	if status != `version="2.4.0"`+"\t"+`storage-error="near \"x\": syntax error\tat\n line 1"` {
+		t.Error("formatStatus did not escape the value:", status)
+	}
+}
+
+func Test_isUnavailable(t *testing.T) {
+	if !isUnavailable(fmt.Errorf("Cannot register: %w", unavailableError{errors.New("timeout")})) {
+		t.Error("isUnavailable does not find a wrapped unavailableError")
+	}
+	if isUnavailable(errors.New("Unknown user")) {
+		t.Error(`isUnavailable("Unknown user") is true`)
+	}
+}
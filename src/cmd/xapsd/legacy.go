@@ -0,0 +1,271 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+//
+// Older versions of xapsd kept their registrations in a JSON file
+// instead of a database:
+//
+//  { "Users": { "stefan": { "Accounts": { "<aps-account-id>": {
+//      "DeviceToken": "<aps-device-token>",
+//      "Mailboxes": ["Inbox", "Notes"] } } } } }
+//
+// The import-legacy subcommand moves those registrations into the
+// configured store, so that devices do not have to register again.
+//
+
+type legacyDatabase struct {
+	Users map[string]*User
+}
+
+//
+// Read the registrations from a legacy database file. Accounts that
+// cannot be imported are skipped; the second result says which and
+// why. Registrations are sorted by username and account id.
+//
+
+func readLegacyDatabase(r io.Reader) ([]Registration, []string, error) {
+	var legacy legacyDatabase
+	if err := json.NewDecoder(r).Decode(&legacy); err != nil {
+		return nil, nil, fmt.Errorf("Cannot read legacy database: %v", err)
+	}
+
+	usernames := make([]string, 0, len(legacy.Users))
+	for username := range legacy.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var (
+		registrations []Registration
+		skipped       []string
+	)
+	for _, username := range usernames {
+		user := legacy.Users[username]
+		if username == "" {
+			skipped = append(skipped, "User without a name")
+			continue
+		}
+		if user == nil || len(user.Accounts) == 0 {
+			skipped = append(skipped, fmt.Sprintf("%s: no accounts", username))
+			continue
+		}
+
+		accountIds := make([]string, 0, len(user.Accounts))
+		for accountId := range user.Accounts {
+			accountIds = append(accountIds, accountId)
+		}
+		sort.Strings(accountIds)
+
+		for _, accountId := range accountIds {
+			account := user.Accounts[accountId]
+			switch {
+			case accountId == "":
+				skipped = append(skipped, fmt.Sprintf("%s: account without an id", username))
+			case account == nil || account.DeviceToken == "":
+				skipped = append(skipped, fmt.Sprintf("%s/%s: no device token", username, accountId))
+			case len(account.Mailboxes) == 0:
+				skipped = append(skipped, fmt.Sprintf("%s/%s: no mailboxes", username, accountId))
+			default:
+				registrations = append(registrations, Registration{
+					Username:    username,
+					AccountId:   accountId,
+					DeviceToken: account.DeviceToken,
+					Subtopic:    account.Subtopic,
+					Mailboxes:   account.Mailboxes,
+				})
+			}
+		}
+	}
+
+	return registrations, skipped, nil
+}
+
+//
+// Stores that only accept some users, like the sql stores with the
+// preset of a mail admin tool, implement userChecker, so that a dry
+// run can report the users that an import would reject.
+//
+
+type userChecker interface {
+	knowsUser(username string) (bool, error)
+}
+
+func runImportLegacy(config string, args []string) error {
+	usage := usageError("import-legacy [-dry-run] file")
+
+	flags := flag.NewFlagSet("import-legacy", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	dryRun := flags.Bool("dry-run", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usage
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	registrations, skipped, err := readLegacyDatabase(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, reason := range skipped {
+		fmt.Println("Skipped", reason)
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		return dryRunImportLegacy(registrations, len(skipped))
+	}
+
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	imported, rejected, err := importLegacyRegistrations(db, registrations)
+	for _, reason := range rejected {
+		fmt.Println("Skipped", reason)
+	}
+	if err != nil {
+		return fmt.Errorf("Imported %d of %d registrations: %v", imported, len(registrations), err)
+	}
+
+	fmt.Printf("Imported %d registrations, skipped %d\n", imported, len(skipped)+len(rejected))
+	if len(rejected) > 0 {
+		return fmt.Errorf("The store rejected %d registrations", len(rejected))
+	}
+	return nil
+}
+
+//
+// Import the registrations. Registrations that the store rejects, for
+// example for unknown users, are skipped; the second result says which
+// and why. If the store is unavailable the import stops.
+//
+
+func importLegacyRegistrations(db registrationStore, registrations []Registration) (int, []string, error) {
+	imported := 0
+	rejected := []string{}
+	for _, reg := range registrations {
+		err := db.importRegistration(reg)
+		if isUnavailable(err) {
+			return imported, rejected, err
+		}
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s/%s: %v", reg.Username, reg.AccountId, err))
+			continue
+		}
+		imported++
+	}
+	return imported, rejected, nil
+}
+
+//
+// Report what an import would do, without changing the store. Users
+// are checked against the store if it can tell which users it knows.
+//
+
+func dryRunImportLegacy(registrations []Registration, skipped int) error {
+	normalizer, err := newUsernameNormalizer()
+	if err != nil {
+		return err
+	}
+
+	open, ok := storageDrivers[Config.Storage.Driver]
+	if !ok {
+		return fmt.Errorf("Unknown storage driver '%s'", Config.Storage.Driver)
+	}
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	checker, _ := db.(userChecker)
+	rejected, err := checkLegacyUsers(checker, normalizer, registrations)
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	for _, reg := range registrations {
+		if reason, ok := rejected[reg.Username]; ok {
+			fmt.Printf("Would skip %s/%s: %s\n", reg.Username, reg.AccountId, reason)
+			skipped++
+			continue
+		}
+		fmt.Printf("Would import %s/%s with %d mailboxes\n", reg.Username, reg.AccountId, len(reg.Mailboxes))
+		imported++
+	}
+	fmt.Printf("Would import %d registrations, skipped %d\n", imported, skipped)
+	return nil
+}
+
+//
+// Return the users of the registrations that the store does not know,
+// with the reason.
+//
+
+func checkLegacyUsers(checker userChecker, normalizer *usernameNormalizer, registrations []Registration) (map[string]string, error) {
+	rejected := make(map[string]string)
+	if checker == nil {
+		return rejected, nil
+	}
+
+	checked := make(map[string]bool)
+	for _, reg := range registrations {
+		if checked[reg.Username] {
+			continue
+		}
+		checked[reg.Username] = true
+
+		username := normalizer.normalize(reg.Username)
+		known, err := checker.knowsUser(username)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot look up user %s: %v", username, err)
+		}
+		if !known {
+			rejected[reg.Username] = "Unknown user " + username
+		}
+	}
+	return rejected, nil
+}
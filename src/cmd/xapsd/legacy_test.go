@@ -0,0 +1,161 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_readLegacyDatabase(t *testing.T) {
+	f, err := os.Open("testdata/database.json")
+	if err != nil {
+		t.Fatal("Cannot open testdata/database.json", err)
+	}
+	defer f.Close()
+
+	registrations, skipped, err := readLegacyDatabase(f)
+	if err != nil {
+		t.Fatal("Cannot read legacy database:", err)
+	}
+	if len(skipped) != 0 {
+		t.Error("Skipped accounts in testdata/database.json:", skipped)
+	}
+	if len(registrations) != 3 {
+		t.Fatal("len(registrations) != 3", registrations)
+	}
+	if reg := registrations[2]; reg.Username != "stefan" || reg.AccountId != "stefanaccountid2" || reg.DeviceToken != "stefandevicetoken2" || len(reg.Mailboxes) != 2 {
+		t.Error("Unexpected registration", reg)
+	}
+}
+
+func Test_readLegacyDatabase_Skipped(t *testing.T) {
+	legacy := `{"Users": {
+		"alice": {"Accounts": {}},
+		"bob": {"Accounts": {
+			"bobaccountid1": {"DeviceToken": "", "Mailboxes": ["Inbox"]},
+			"bobaccountid2": {"DeviceToken": "bobdevicetoken2", "Mailboxes": []},
+			"bobaccountid3": {"DeviceToken": "bobdevicetoken3", "Mailboxes": ["Inbox"]}}}}}`
+
+	registrations, skipped, err := readLegacyDatabase(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatal("Cannot read legacy database:", err)
+	}
+	if len(registrations) != 1 || registrations[0].AccountId != "bobaccountid3" {
+		t.Error("registrations != [bobaccountid3]", registrations)
+	}
+
+	expected := []string{"alice: no accounts", "bob/bobaccountid1: no device token", "bob/bobaccountid2: no mailboxes"}
+	if strings.Join(skipped, "\n") != strings.Join(expected, "\n") {
+		t.Error("Unexpected skipped accounts:", skipped)
+	}
+
+	if _, _, err := readLegacyDatabase(strings.NewReader(`{"Users": [`)); err == nil {
+		t.Error("readLegacyDatabase accepted a broken file")
+	}
+}
+
+type rejectingStore struct {
+	registrationStore
+	username string
+}
+
+func (s *rejectingStore) importRegistration(reg Registration) error {
+	if reg.Username == s.username {
+		return fmt.Errorf("Unknown user %s", reg.Username)
+	}
+	return s.registrationStore.importRegistration(reg)
+}
+
+func Test_importLegacyRegistrations(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	registrations := []Registration{
+		{Username: "alice@example.com", AccountId: "aliceaccountid", DeviceToken: "alicedevicetoken", Mailboxes: []string{"Inbox"}},
+		{Username: "bob@example.com", AccountId: "bobaccountid", DeviceToken: "bobdevicetoken", Mailboxes: []string{"Inbox"}},
+		{Username: "carol@example.com", AccountId: "carolaccountid", DeviceToken: "caroldevicetoken", Mailboxes: []string{"Inbox"}},
+	}
+
+	// Rejected registrations are skipped and the rest is imported
+	imported, rejected, err := importLegacyRegistrations(&rejectingStore{db, "bob@example.com"}, registrations)
+	if err != nil {
+		t.Fatal("Cannot importLegacyRegistrations:", err)
+	}
+	if imported != 2 || len(rejected) != 1 || rejected[0] != "bob@example.com/bobaccountid: Unknown user bob@example.com" {
+		t.Error("Unexpected import result:", imported, rejected)
+	}
+	if list, err := db.listRegistrations(); err != nil || len(list) != 2 {
+		t.Error("len(listRegistrations()) != 2", list, err)
+	}
+
+	// An unavailable store stops the import
+	health := newHealthStore(func() (registrationStore, error) { return nil, unavailableError{errors.New("connection refused")} }, nil, unavailableError{errors.New("connection refused")}, time.Hour, time.Hour)
+	if imported, _, err := importLegacyRegistrations(health, registrations); !isUnavailable(err) || imported != 0 {
+		t.Error("importLegacyRegistrations did not stop for an unavailable store:", imported, err)
+	}
+}
+
+func Test_checkLegacyUsers(t *testing.T) {
+	_, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	// Only users that are already known are accepted
+	defer func(queries map[string]SQLQueries) { Config.DB.Queries = queries }(Config.DB.Queries)
+	Config.DB.Queries = map[string]SQLQueries{
+		"insert_mbx_id": {`INSERT INTO xaps_users (local_part, domain) SELECT ?, ? WHERE 1 = 0`},
+	}
+	db, err := connectDatabase(sqliteDialect)
+	if err != nil {
+		t.Fatal("Cannot connectDatabase:", err)
+	}
+	defer db.close()
+	if _, err := db.conn.Exec(`INSERT INTO xaps_users (local_part, domain) VALUES ('alice', 'example.com')`); err != nil {
+		t.Fatal("Cannot add user:", err)
+	}
+
+	normalizer, err := newUsernameNormalizer()
+	if err != nil {
+		t.Fatal("Cannot newUsernameNormalizer:", err)
+	}
+	registrations := []Registration{{Username: "alice@example.com"}, {Username: "bob@example.com"}, {Username: "bob@example.com"}}
+	rejected, err := checkLegacyUsers(db, normalizer, registrations)
+	if err != nil {
+		t.Fatal("Cannot checkLegacyUsers:", err)
+	}
+	if len(rejected) != 1 || rejected["bob@example.com"] != "Unknown user bob@example.com" {
+		t.Error(`checkLegacyUsers() != [bob@example.com]`, rejected)
+	}
+
+	// Checking does not add users
+	var users int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM xaps_users`).Scan(&users); err != nil || users != 1 {
+		t.Error("checkLegacyUsers changed the users:", users, err)
+	}
+}
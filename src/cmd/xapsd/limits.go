@@ -0,0 +1,142 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+//
+// Limits keep a misbehaving client from registering an unbounded
+// number of devices or mailboxes for a user, which would make every
+// NOTIFY for that user fan out to all of them. A new device that would
+// go over the device limit is either refused, or the devices that
+// registered least recently are removed to make room for it.
+//
+
+const (
+	devicePolicyReject      = "reject"
+	devicePolicyEvictOldest = "evict-oldest"
+)
+
+func checkLimits() error {
+	switch Config.Limits.DevicePolicy {
+	case "", devicePolicyReject, devicePolicyEvictOldest:
+		return nil
+	}
+	return fmt.Errorf("Invalid DevicePolicy '%s', must be %s or %s", Config.Limits.DevicePolicy, devicePolicyReject, devicePolicyEvictOldest)
+}
+
+//
+// A limitError means that a REGISTER was refused because of a limit.
+// That is a problem with the request, so it is not retried.
+//
+
+type limitError struct {
+	msg string
+}
+
+func (e limitError) Error() string {
+	return e.msg
+}
+
+func isLimitError(err error) bool {
+	var limit limitError
+	return errors.As(err, &limit)
+}
+
+//
+// A limitingStore enforces the limits on REGISTER. The check, the
+// registration and the removal of old devices happen under a lock per
+// user, so that concurrent REGISTERs cannot both pass the check. Old
+// devices are only removed once the new registration is stored.
+//
+
+type limitingStore struct {
+	registrationStore
+	locks keyedMutex
+
+	// The file store keeps one registration per account id, so a
+	// device that registers with a new device token replaces its
+	// registration and does not count as another device
+	byAccount bool
+}
+
+func (s *limitingStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	if max := Config.Limits.MailboxesPerRegistration; max > 0 && len(mailboxes) > max {
+		return limitError{fmt.Sprintf("Too many mailboxes: %d, at most %d are allowed", len(mailboxes), max)}
+	}
+
+	max := Config.Limits.DevicesPerUser
+	if max <= 0 {
+		return s.registrationStore.addRegistration(username, accountId, deviceToken, subtopic, mailboxes)
+	}
+
+	defer s.locks.lock(username)()
+
+	registrations, err := s.userRegistrations(username)
+	if err != nil {
+		return err
+	}
+
+	others := make([]Registration, 0, len(registrations))
+	for _, reg := range registrations {
+		if reg.AccountId == accountId && (reg.DeviceToken == deviceToken || s.byAccount) {
+			continue
+		}
+		others = append(others, reg)
+	}
+
+	var evict []Registration
+	if len(others) >= max {
+		if Config.Limits.DevicePolicy != devicePolicyEvictOldest {
+			return limitError{fmt.Sprintf("Too many devices: at most %d are allowed per user", max)}
+		}
+		sort.SliceStable(others, func(i, j int) bool {
+			return others[i].LastRegistered.Before(others[j].LastRegistered)
+		})
+		evict = others[:len(others)-max+1]
+	}
+
+	if err := s.registrationStore.addRegistration(username, accountId, deviceToken, subtopic, mailboxes); err != nil {
+		return err
+	}
+
+	// The device is registered, so a device that cannot be removed
+	// only means the user is over the limit until the next REGISTER
+	for _, reg := range evict {
+		if err := s.deleteRegistration(reg); err != nil {
+			log.Printf("Cannot remove registration of %s/%s to stay within the limit: %v", reg.Username, auditPrefix(reg.AccountId), err)
+			continue
+		}
+		recordAudit(auditRemoved, reg, fmt.Sprintf("evicted, at most %d devices are allowed per user", max))
+		log.Printf("Removed registration of %s/%s, at most %d devices are allowed per user", reg.Username, auditPrefix(reg.AccountId), max)
+	}
+
+	return nil
+}
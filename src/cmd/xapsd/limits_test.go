@@ -0,0 +1,180 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func setTestLimits(devices, mailboxes int, policy string) func() {
+	restore := Config.Limits
+	Config.Limits.DevicesPerUser = devices
+	Config.Limits.MailboxesPerRegistration = mailboxes
+	Config.Limits.DevicePolicy = policy
+	return func() { Config.Limits = restore }
+}
+
+func Test_limitingStore(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+	defer setTestLimits(2, 2, devicePolicyReject)()
+
+	store := &limitingStore{registrationStore: db}
+	register := func(username, accountId, deviceToken string, mailboxes ...string) error {
+		return store.addRegistration(username, accountId, deviceToken, "com.apple.mobilemail", mailboxes)
+	}
+
+	if err := register("test@example.com", "testaccountid1", "testtoken1", "Inbox", "Notes", "Ham"); !isLimitError(err) {
+		t.Error("limitingStore allowed too many mailboxes:", err)
+	}
+
+	if err := register("test@example.com", "testaccountid1", "testtoken1", "Inbox"); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+	if err := register("test@example.com", "testaccountid2", "testtoken2", "Inbox"); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+	if _, err := db.conn.Exec(`UPDATE xaps_registrations SET last_registered_at = '2000-01-01 00:00:00' WHERE account_id = 'testaccountid2'`); err != nil {
+		t.Fatal("Cannot change registration time:", err)
+	}
+
+	// Registered devices can register again
+	if err := register("test@example.com", "testaccountid1", "testtoken1", "Inbox"); err != nil {
+		t.Error("limitingStore refused a registered device:", err)
+	}
+	if err := register("other@example.com", "testaccountid3", "testtoken3", "Inbox"); err != nil {
+		t.Error("limitingStore refused a device of another user:", err)
+	}
+	if err := register("test@example.com", "testaccountid3", "testtoken3", "Inbox"); !isLimitError(err) {
+		t.Error("limitingStore allowed too many devices:", err)
+	}
+
+	Config.Limits.DevicePolicy = devicePolicyEvictOldest
+	if err := register("test@example.com", "testaccountid3", "testtoken3", "Inbox"); err != nil {
+		t.Error("limitingStore did not make room:", err)
+	}
+	registrations, err := db.userRegistrations("test@example.com")
+	if err != nil || len(registrations) != 2 {
+		t.Fatal("Cannot userRegistrations:", registrations, err)
+	}
+	for _, reg := range registrations {
+		if reg.AccountId == "testaccountid2" {
+			t.Error("limitingStore did not remove the oldest device", registrations)
+		}
+	}
+}
+
+//
+// Nothing is removed when the new device cannot be registered.
+//
+
+func Test_limitingStore_AddFails(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+	defer setTestLimits(1, 0, devicePolicyEvictOldest)()
+
+	store := &limitingStore{registrationStore: db}
+	if err := store.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+	if _, err := db.conn.Exec(`CREATE TRIGGER reject_registration BEFORE INSERT ON xaps_registrations BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal("Cannot create trigger:", err)
+	}
+	if err := store.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox"}); err == nil || isLimitError(err) {
+		t.Error("addRegistration did not fail:", err)
+	}
+	if registrations, err := db.userRegistrations("test@example.com"); err != nil || len(registrations) != 1 {
+		t.Error("A device was removed for a registration that failed", registrations, err)
+	}
+}
+
+func Test_limitingStore_Concurrent(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+	defer setTestLimits(2, 0, devicePolicyReject)()
+
+	store := &limitingStore{registrationStore: db}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := store.addRegistration("test@example.com", "testaccountid"+id, "testtoken"+id, "com.apple.mobilemail", []string{"Inbox"}); err != nil && !isLimitError(err) {
+				t.Error("Cannot addRegistration:", err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	if registrations, err := db.userRegistrations("test@example.com"); err != nil || len(registrations) != 2 {
+		t.Error("Concurrent registrations went over the limit", len(registrations), err)
+	}
+}
+
+func Test_checkLimits(t *testing.T) {
+	defer func(policy string) { Config.Limits.DevicePolicy = policy }(Config.Limits.DevicePolicy)
+
+	Config.Limits.DevicePolicy = "evict-newest"
+	if err := checkLimits(); err == nil {
+		t.Error("checkLimits accepted an unknown policy")
+	}
+}
+
+//
+// The file store replaces the registration of an account, so a new
+// device token for an account is not another device.
+//
+
+func Test_limitingStore_File(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "limits_test_Test_limitingStore_File")
+	if err != nil {
+		t.Fatal("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	db, err := newDatabase(f.Name())
+	if err != nil {
+		t.Fatal("Cannot open database", err)
+	}
+	defer setTestLimits(2, 0, devicePolicyReject)()
+
+	store := &limitingStore{registrationStore: db, byAccount: true}
+	for _, id := range []string{"1", "2"} {
+		if err := store.addRegistration("test@example.com", "testaccountid"+id, "testtoken"+id, "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+			t.Fatal("Cannot addRegistration:", err)
+		}
+	}
+	if err := store.addRegistration("test@example.com", "testaccountid1", "newtoken1", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("limitingStore refused a new device token for a registered account:", err)
+	}
+	if err := store.addRegistration("test@example.com", "testaccountid3", "testtoken3", "com.apple.mobilemail", []string{"Inbox"}); !isLimitError(err) {
+		t.Error("limitingStore allowed too many devices:", err)
+	}
+}
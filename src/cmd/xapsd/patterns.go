@@ -0,0 +1,180 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//
+// Registrations can subscribe to mailbox patterns instead of exact
+// mailbox names, so that mail in a folder that was created after the
+// device registered, for example by a Sieve rule, is still pushed.
+// Patterns use the IMAP LIST wildcards: * matches any characters and %
+// matches any characters except the hierarchy delimiter. "Lists/*"
+// matches every mailbox below Lists, "Lists/%" only the direct
+// children.
+//
+
+func isMailboxPattern(mailbox string) bool {
+	return strings.ContainsAny(mailbox, "*%")
+}
+
+//
+// Patterns come from clients and are matched on every NOTIFY, so their
+// size is limited at REGISTER.
+//
+
+const (
+	maxPatternLength    = 255
+	maxPatternWildcards = 8
+)
+
+func checkMailboxPatterns(mailboxes []string) error {
+	for _, mailbox := range mailboxes {
+		if !isMailboxPattern(mailbox) {
+			continue
+		}
+		if len(mailbox) > maxPatternLength {
+			return fmt.Errorf("Mailbox pattern is too long: %d characters, at most %d are allowed", len(mailbox), maxPatternLength)
+		}
+		if n := strings.Count(mailbox, "*") + strings.Count(mailbox, "%"); n > maxPatternWildcards {
+			return fmt.Errorf("Mailbox pattern %s has %d wildcards, at most %d are allowed", mailbox, n, maxPatternWildcards)
+		}
+	}
+	return nil
+}
+
+//
+// Without patterns, wildcards in the default mailboxes would be stored
+// as mailbox names and never match.
+//
+
+func checkPatterns() error {
+	if !Config.Mailboxes.Patterns {
+		for _, mailbox := range Config.Mailboxes.Default {
+			if isMailboxPattern(mailbox) {
+				return fmt.Errorf("Default mailbox %s is a pattern, but Patterns is off", mailbox)
+			}
+		}
+		return nil
+	}
+	if err := checkMailboxPatterns(Config.Mailboxes.Default); err != nil {
+		return fmt.Errorf("Invalid Default mailboxes: %v", err)
+	}
+	return nil
+}
+
+//
+// Match a mailbox against a pattern without recursion. On a mismatch
+// only the last * is extended, and the last % after it as long as it
+// does not reach a delimiter. Everything before the last * already
+// matched as early as possible, and the * can take up whatever a later
+// match would need, so that never has to be undone.
+//
+
+func mailboxMatches(pattern, mailbox, delimiter string) bool {
+	p, m := 0, 0
+	star, starMailbox := -1, 0
+	percent, percentMailbox := -1, 0
+
+	for m < len(mailbox) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, starMailbox = p, m
+			percent = -1
+			p++
+		case p < len(pattern) && pattern[p] == '%':
+			percent, percentMailbox = p, m
+			p++
+		case p < len(pattern) && pattern[p] == mailbox[m]:
+			p++
+			m++
+		case percent >= 0 && (delimiter == "" || !strings.HasPrefix(mailbox[percentMailbox:], delimiter)):
+			percentMailbox++
+			p, m = percent+1, percentMailbox
+		case star >= 0:
+			starMailbox++
+			p, m = star+1, starMailbox
+			percent = -1
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && (pattern[p] == '*' || pattern[p] == '%') {
+		p++
+	}
+	return p == len(pattern)
+}
+
+//
+// A patternStore adds the registrations of a user with a mailbox
+// pattern that matches to the registrations for the exact mailbox.
+// The stores only return the registrations that have patterns, so a
+// NOTIFY for a user without patterns costs one more query.
+//
+
+type patternStore struct {
+	registrationStore
+	delimiter string
+}
+
+func (s *patternStore) findRegistrations(username, mailbox string) ([]Registration, error) {
+	registrations, err := s.registrationStore.findRegistrations(username, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := s.patternRegistrations(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		if containsRegistration(registrations, candidate) {
+			continue
+		}
+		for _, pattern := range candidate.Mailboxes {
+			if isMailboxPattern(pattern) && mailboxMatches(pattern, mailbox, s.delimiter) {
+				candidate.Mailboxes = nil
+				registrations = append(registrations, candidate)
+				break
+			}
+		}
+	}
+
+	return registrations, nil
+}
+
+func containsRegistration(registrations []Registration, reg Registration) bool {
+	for _, r := range registrations {
+		if r.AccountId == reg.AccountId && r.DeviceToken == reg.DeviceToken {
+			return true
+		}
+	}
+	return false
+}
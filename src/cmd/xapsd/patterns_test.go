@@ -0,0 +1,194 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_mailboxMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		mailbox string
+		matches bool
+	}{
+		{"Inbox", "Inbox", true},
+		{"Inbox", "Inbox/Sub", false},
+		{"*", "Lists/Go/Announce", true},
+		{"%", "Lists", true},
+		{"%", "Lists/Go", false},
+		{"Lists/*", "Lists/Go/Announce", true},
+		{"Lists/*", "Lists", false},
+		{"Lists/%", "Lists/Go", true},
+		{"Lists/%", "Lists/Go/Announce", false},
+		{"Lists/%/Announce", "Lists/Go/Announce", true},
+		{"%/Announce", "Lists/Go/Announce", false},
+		{"*/Announce", "Lists/Go/Announce", true},
+		{"Lists*", "Lists", true},
+		{"Lists*", "Archive", false},
+		{"*%b", "a/xb", true},
+		{"%*b", "a/xb", true},
+		{"%a%/b", "xaya/b", true},
+		{"%a%/b", "xa/ya/b", false},
+		{"*/%/%", "a/b/c/d", true},
+		{"*a*a*a*a*a*a*a*ab", strings.Repeat("a", 40), false},
+	}
+	for _, test := range tests {
+		if mailboxMatches(test.pattern, test.mailbox, "/") != test.matches {
+			t.Errorf("mailboxMatches(%q, %q) != %v", test.pattern, test.mailbox, test.matches)
+		}
+	}
+}
+
+//
+// A pattern with many wildcards that almost matches took seconds with
+// a recursive matcher.
+//
+
+func Test_mailboxMatches_Pathological(t *testing.T) {
+	pattern := strings.Repeat("*a", 100) + "b"
+	mailbox := strings.Repeat("a", 1000)
+
+	start := time.Now()
+	if mailboxMatches(pattern, mailbox, "/") {
+		t.Error("mailboxMatches matched a mailbox without b")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("mailboxMatches took", elapsed)
+	}
+}
+
+//
+// Compare with a simple recursive matcher on every short pattern and
+// mailbox over a small alphabet.
+//
+
+func Test_mailboxMatches_Recursive(t *testing.T) {
+	var recursive func(pattern, mailbox string) bool
+	recursive = func(pattern, mailbox string) bool {
+		if pattern == "" {
+			return mailbox == ""
+		}
+		switch pattern[0] {
+		case '*', '%':
+			for i := 0; i <= len(mailbox); i++ {
+				if recursive(pattern[1:], mailbox[i:]) {
+					return true
+				}
+				if i < len(mailbox) && pattern[0] == '%' && mailbox[i] == '/' {
+					return false
+				}
+			}
+			return false
+		default:
+			return mailbox != "" && pattern[0] == mailbox[0] && recursive(pattern[1:], mailbox[1:])
+		}
+	}
+
+	var words func(alphabet string, n int) []string
+	words = func(alphabet string, n int) []string {
+		if n == 0 {
+			return []string{""}
+		}
+		all := []string{""}
+		for _, s := range words(alphabet, n-1) {
+			for _, c := range alphabet {
+				all = append(all, s+string(c))
+			}
+		}
+		return all
+	}
+
+	for _, pattern := range words("a/*%", 5) {
+		for _, mailbox := range words("ab/", 5) {
+			if mailboxMatches(pattern, mailbox, "/") != recursive(pattern, mailbox) {
+				t.Errorf("mailboxMatches(%q, %q) != %v", pattern, mailbox, recursive(pattern, mailbox))
+			}
+		}
+	}
+}
+
+func Test_checkMailboxPatterns(t *testing.T) {
+	if err := checkMailboxPatterns([]string{"Inbox", "Lists/*", strings.Repeat("x", 300)}); err != nil {
+		t.Error("checkMailboxPatterns refused mailboxes:", err)
+	}
+	if err := checkMailboxPatterns([]string{strings.Repeat("*a", 9)}); err == nil {
+		t.Error("checkMailboxPatterns allowed too many wildcards")
+	}
+	if err := checkMailboxPatterns([]string{"Lists/*" + strings.Repeat("x", 250)}); err == nil {
+		t.Error("checkMailboxPatterns allowed a long pattern")
+	}
+}
+
+func Test_checkPatterns(t *testing.T) {
+	restore := Config.Mailboxes
+	defer func() { Config.Mailboxes = restore }()
+
+	Config.Mailboxes.Patterns = false
+	Config.Mailboxes.Default = []string{"INBOX", "Lists/*"}
+	if err := checkPatterns(); err == nil {
+		t.Error("checkPatterns accepted a default pattern without Patterns")
+	}
+	Config.Mailboxes.Patterns = true
+	if err := checkPatterns(); err != nil {
+		t.Error("checkPatterns refused a default pattern:", err)
+	}
+}
+
+func Test_patternStore(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	store := &patternStore{db, "/"}
+	if err := store.addRegistration("test@example.com", "testaccountid1", "testtoken1", "com.apple.mobilemail", []string{"Inbox", "Lists/%"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+	if err := store.addRegistration("test@example.com", "testaccountid2", "testtoken2", "com.apple.mobilemail", []string{"Inbox", "Lists/Go"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+
+	if candidates, err := db.patternRegistrations("test@example.com"); err != nil || len(candidates) != 1 || candidates[0].AccountId != "testaccountid1" {
+		t.Error(`patternRegistrations("test@example.com") != [testaccountid1]`, candidates, err)
+	}
+
+	registrations, err := store.findRegistrations("test@example.com", "Lists/Go")
+	if err != nil || len(registrations) != 2 {
+		t.Error(`len(findRegistrations("Lists/Go")) != 2`, registrations, err)
+	}
+
+	registrations, err = store.findRegistrations("test@example.com", "Lists/Rust")
+	if err != nil || len(registrations) != 1 || registrations[0].AccountId != "testaccountid1" {
+		t.Error(`findRegistrations("Lists/Rust") != [testaccountid1]`, registrations, err)
+	}
+
+	if registrations, err := store.findRegistrations("test@example.com", "Lists/Rust/Announce"); err != nil || len(registrations) != 0 {
+		t.Error(`len(findRegistrations("Lists/Rust/Announce")) != 0`, registrations, err)
+	}
+	if registrations, err := store.findRegistrations("test@example.com", "Inbox"); err != nil || len(registrations) != 2 {
+		t.Error(`len(findRegistrations("Inbox")) != 2`, registrations, err)
+	}
+}
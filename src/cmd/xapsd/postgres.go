@@ -0,0 +1,116 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+//
+// The postgres storage driver uses the connection settings from
+// Config.DB, like the mysql driver. Config.DB.Socket is the directory
+// that contains the PostgreSQL socket, usually /var/run/postgresql.
+//
+
+var postgresDialect = &sqlDialect{driver: "postgres", replicas: true, dsn: postgresDSN, rebind: rebindDollar, migrations: postgresMigrations}
+
+func init() {
+	registerSQLDialect("postgres", postgresDialect)
+}
+
+//
+// Build a libpq style connection string. Config.DB.Options holds
+// additional parameters in URL query form, for example
+// connect_timeout=5&application_name=xapsd.
+//
+
+func postgresDSN() string {
+	params := map[string]string{
+		"user":            Config.DB.User,
+		"password":        Config.DB.Password,
+		"dbname":          Config.DB.Name,
+		"connect_timeout": "5",
+	}
+
+	if Config.DB.Socket != "" {
+		params["host"] = Config.DB.Socket
+	} else if Config.DB.Host != "" {
+		params["host"] = Config.DB.Host
+	}
+	if Config.DB.Port != 0 {
+		params["port"] = strconv.FormatUint(uint64(Config.DB.Port), 10)
+	}
+	if Config.DB.SSLMode != "" {
+		params["sslmode"] = Config.DB.SSLMode
+	}
+	if Config.DB.SearchPath != "" {
+		params["search_path"] = Config.DB.SearchPath
+	}
+
+	if options, err := url.ParseQuery(Config.DB.Options); err == nil {
+		for name := range options {
+			params[name] = options.Get(name)
+		}
+	}
+
+	names := make([]string, 0, len(params))
+	for name, value := range params {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+quoteDSNValue(params[name]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+//
+// Replace the ? placeholders in a query with $1, $2 and so on.
+//
+
+func rebindDollar(query string) string {
+	rebound, _ := scanPlaceholders(query, func(n int) string {
+		return "$" + strconv.Itoa(n)
+	})
+	return rebound
+}
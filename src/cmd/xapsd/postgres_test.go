@@ -0,0 +1,67 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func Test_rebindDollar(t *testing.T) {
+	queries := map[string]string{
+		`SELECT id FROM users WHERE local_part = ? AND domain = ?`:            `SELECT id FROM users WHERE local_part = $1 AND domain = $2`,
+		`SELECT '?' FROM "odd?name" WHERE a = ? -- why?` + "\n" + `AND b = ?`: `SELECT '?' FROM "odd?name" WHERE a = $1 -- why?` + "\n" + `AND b = $2`,
+		`SELECT 'it''s' WHERE x = ?`:                                          `SELECT 'it''s' WHERE x = $1`,
+		`SELECT a /* why? */ FROM t WHERE x = ? /* ? */`:                      `SELECT a /* why? */ FROM t WHERE x = $1 /* ? */`,
+		`SELECT a FROM t WHERE x = ? /* unterminated ?`:                       `SELECT a FROM t WHERE x = $1 /* unterminated ?`,
+		`DELETE FROM t WHERE id = 1`:                                          `DELETE FROM t WHERE id = 1`,
+	}
+
+	for query, expected := range queries {
+		if rebound := rebindDollar(query); rebound != expected {
+			t.Errorf("rebindDollar(%q) = %q, expected %q", query, rebound, expected)
+		}
+	}
+}
+
+func Test_postgresDSN(t *testing.T) {
+	defer func(db string, user string, password string, socket string, port uint16, sslmode string, searchPath string, options string) {
+		Config.DB.Name, Config.DB.User, Config.DB.Password, Config.DB.Socket = db, user, password, socket
+		Config.DB.Port, Config.DB.SSLMode, Config.DB.SearchPath, Config.DB.Options = port, sslmode, searchPath, options
+	}(Config.DB.Name, Config.DB.User, Config.DB.Password, Config.DB.Socket, Config.DB.Port, Config.DB.SSLMode, Config.DB.SearchPath, Config.DB.Options)
+
+	Config.DB.Name = "mail"
+	Config.DB.User = "xapsd"
+	Config.DB.Password = "it's secret"
+	Config.DB.Socket = "/var/run/postgresql"
+	Config.DB.Port = 0
+	Config.DB.SSLMode = "disable"
+	Config.DB.SearchPath = "xapsd,public"
+	Config.DB.Options = "application_name=xapsd&connect_timeout=10"
+
+	expected := `application_name=xapsd connect_timeout=10 dbname=mail host=/var/run/postgresql password='it\'s secret' search_path=xapsd,public sslmode=disable user=xapsd`
+	if dsn := postgresDSN(); dsn != expected {
+		t.Errorf("postgresDSN() = %q, expected %q", dsn, expected)
+	}
+}
@@ -0,0 +1,118 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+//
+// Query presets provide all queries for common mail server setups.
+// Every preset keeps the registrations in the xapsd schema, which is
+// installed with "xapsd migrate up". Presets for mail admin tools only
+// accept users that have an active mailbox in the tables of that tool.
+// Select a preset with Config.DB.Preset; queries in Config.DB.Queries
+// replace single queries of the preset.
+//
+
+var queryPresets = map[string]map[string]string{
+	"standalone": standaloneQueries,
+
+	// PostfixAdmin keeps mailboxes in the mailbox table, with the
+	// address split into local_part and domain.
+	"postfixadmin": withQueries(standaloneQueries, map[string]string{
+		"insert_mbx_id": `INSERT INTO xaps_users (local_part, domain)
+			SELECT local_part, domain FROM mailbox WHERE local_part = ? AND domain = ? AND active = '1'`,
+	}),
+
+	// ViMbAdmin keeps the local part in the mailbox table and the
+	// domain in the domain table.
+	"vimbadmin": withQueries(standaloneQueries, map[string]string{
+		"insert_mbx_id": `INSERT INTO xaps_users (local_part, domain)
+			SELECT m.local_part, d.domain FROM mailbox m JOIN domain d ON d.id = m.Domain_id
+			WHERE m.local_part = ? AND d.domain = ? AND m.active = '1'`,
+	}),
+
+	// iRedMail uses a PostfixAdmin compatible mailbox table, but also
+	// disables mailboxes that have expired.
+	"iredmail": withQueries(standaloneQueries, map[string]string{
+		"insert_mbx_id": `INSERT INTO xaps_users (local_part, domain)
+			SELECT local_part, domain FROM mailbox WHERE local_part = ? AND domain = ? AND active = '1'
+			AND (expired IS NULL OR expired > CURRENT_TIMESTAMP)`,
+	}),
+}
+
+//
+// The standalone preset has no user table of its own: every user that
+// registers a device is added to xaps_users.
+//
+
+var standaloneQueries = map[string]string{
+	"select_mbx_id":          `SELECT id FROM xaps_users WHERE local_part = ? AND domain = ?`,
+	"insert_mbx_id":          `INSERT INTO xaps_users (local_part, domain) VALUES (?, ?)`,
+	"select_aps_settings_id": `SELECT id FROM xaps_registrations WHERE user_id = ? AND account_id = ? AND device_token = ?`,
+	"insert_aps":             `INSERT INTO xaps_registrations (user_id, account_id, device_token) VALUES (?, ?, ?)`,
+	"set_aps_subtopic":       `UPDATE xaps_registrations SET subtopic = ? WHERE id = ?`,
+	"set_aps_sealed":         `UPDATE xaps_registrations SET sealed = ? WHERE id = ?`,
+	"get_aps_mailboxes":      `SELECT id, name FROM xaps_mailboxes WHERE registration_id = ?`,
+	"insert_aps_mailbox":     `INSERT INTO xaps_mailboxes (registration_id, name) VALUES (?, ?)`,
+	"delete_aps_mailbox":     `DELETE FROM xaps_mailboxes WHERE id = ?`,
+	"find_registration": `SELECT r.id, r.account_id, r.device_token, r.subtopic, r.sealed
+		FROM xaps_registrations r
+		JOIN xaps_mailboxes m ON m.registration_id = r.id
+		JOIN xaps_users u ON u.id = r.user_id
+		WHERE m.name = ? AND u.local_part = ? AND u.domain = ?`,
+	"delete_registration": `DELETE FROM xaps_registrations WHERE id = ?`,
+	"list_registrations": `SELECT r.id, CONCAT(u.local_part, CASE WHEN u.domain = '' THEN '' ELSE '@' END, u.domain), r.account_id, r.device_token, r.subtopic, r.created_at, r.last_registered_at, r.sealed
+		FROM xaps_registrations r
+		JOIN xaps_users u ON u.id = r.user_id
+		ORDER BY u.domain, u.local_part, r.account_id`,
+	"touch_aps":     `UPDATE xaps_registrations SET last_registered_at = ? WHERE id = ?`,
+	"set_aps_times": `UPDATE xaps_registrations SET created_at = ?, last_registered_at = ? WHERE id = ?`,
+	"find_stale_registrations": `SELECT r.id, CONCAT(u.local_part, CASE WHEN u.domain = '' THEN '' ELSE '@' END, u.domain), r.account_id, r.device_token, r.subtopic, r.created_at, r.last_registered_at, r.sealed
+		FROM xaps_registrations r
+		JOIN xaps_users u ON u.id = r.user_id
+		WHERE r.last_registered_at < ?`,
+	"find_token_registrations": `SELECT r.id, CONCAT(u.local_part, CASE WHEN u.domain = '' THEN '' ELSE '@' END, u.domain), r.account_id, r.device_token, r.subtopic, r.created_at, r.last_registered_at, r.sealed
+		FROM xaps_registrations r
+		JOIN xaps_users u ON u.id = r.user_id
+		WHERE r.device_token = ?`,
+	"find_pattern_registrations": `SELECT r.id, CONCAT(u.local_part, CASE WHEN u.domain = '' THEN '' ELSE '@' END, u.domain), r.account_id, r.device_token, r.subtopic, r.created_at, r.last_registered_at, r.sealed
+		FROM xaps_registrations r
+		JOIN xaps_users u ON u.id = r.user_id
+		WHERE u.local_part = ? AND u.domain = ? AND EXISTS (SELECT 1 FROM xaps_mailboxes m
+			WHERE m.registration_id = r.id AND (m.name LIKE '%*%' OR m.name LIKE '%!%%' ESCAPE '!'))`,
+	"find_user_registrations": `SELECT r.id, CONCAT(u.local_part, CASE WHEN u.domain = '' THEN '' ELSE '@' END, u.domain), r.account_id, r.device_token, r.subtopic, r.created_at, r.last_registered_at, r.sealed
+		FROM xaps_registrations r
+		JOIN xaps_users u ON u.id = r.user_id
+		WHERE u.local_part = ? AND u.domain = ?`,
+}
+
+func withQueries(preset map[string]string, queries map[string]string) map[string]string {
+	merged := make(map[string]string, len(preset)+len(queries))
+	for name, sql := range preset {
+		merged[name] = sql
+	}
+	for name, sql := range queries {
+		merged[name] = sql
+	}
+	return merged
+}
@@ -0,0 +1,77 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func Test_queryPresets_AreComplete(t *testing.T) {
+	required := []string{"select_mbx_id", "select_aps_settings_id", "insert_aps", "get_aps_mailboxes",
+		"insert_aps_mailbox", "delete_aps_mailbox", "find_registration", "delete_registration"}
+
+	for name, preset := range queryPresets {
+		for _, query := range required {
+			if _, ok := preset[query]; !ok {
+				t.Errorf("Preset %s has no %s query", name, query)
+			}
+		}
+	}
+}
+
+func Test_queryPresets_PostfixAdmin(t *testing.T) {
+	standalone, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	_, err := standalone.conn.Exec(`CREATE TABLE mailbox (username TEXT, local_part TEXT, domain TEXT, active INTEGER)`)
+	if err != nil {
+		t.Fatal("Cannot create mailbox table:", err)
+	}
+	_, err = standalone.conn.Exec(`INSERT INTO mailbox VALUES ('test@example.com', 'test', 'example.com', 1), ('old@example.com', 'old', 'example.com', 0)`)
+	if err != nil {
+		t.Fatal("Cannot insert mailboxes:", err)
+	}
+
+	defer func(preset string) { Config.DB.Preset = preset }(Config.DB.Preset)
+	Config.DB.Preset = "postfixadmin"
+
+	db, err := connectDatabase(sqliteDialect)
+	if err != nil {
+		t.Fatal("Cannot open database with the postfixadmin preset:", err)
+	}
+	defer db.close()
+
+	if err := db.addRegistration("test@example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration:", err)
+	}
+
+	if err := db.addRegistration("old@example.com", "oldaccountid", "oldtoken", "com.apple.mobilemail", []string{"Inbox"}); err == nil {
+		t.Error("addRegistration accepted an inactive mailbox")
+	}
+
+	if err := db.addRegistration("nobody@example.com", "nobodyaccountid", "nobodytoken", "com.apple.mobilemail", []string{"Inbox"}); err == nil {
+		t.Error("addRegistration accepted an unknown user")
+	}
+}
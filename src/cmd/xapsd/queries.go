@@ -0,0 +1,241 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// The queries that the sql storage drivers run, with the number of ?
+// placeholders they take and the number of columns they return. A nil
+// columns list means the query does not return rows. Queries are
+// checked with their queryTestArgs, or with zeros.
+//
+
+type querySpec struct {
+	params   int
+	columns  []int
+	required bool
+}
+
+var querySpecs = map[string]querySpec{
+	"select_mbx_id":              {2, []int{1}, true},
+	"insert_mbx_id":              {2, nil, false},
+	"select_aps_settings_id":     {3, []int{1}, true},
+	"insert_aps":                 {3, nil, true},
+	"set_aps_subtopic":           {2, nil, false},
+	"set_aps_sealed":             {2, nil, false},
+	"get_aps_mailboxes":          {1, []int{2}, true},
+	"insert_aps_mailbox":         {2, nil, true},
+	"delete_aps_mailbox":         {1, nil, true},
+	"find_registration":          {3, []int{3, 4, 5}, true},
+	"delete_registration":        {1, nil, true},
+	"list_registrations":         {0, []int{4, 5, 7, 8}, false},
+	"touch_aps":                  {2, nil, false},
+	"set_aps_times":              {3, nil, false},
+	"find_token_registrations":   {1, []int{4, 5, 7, 8}, false},
+	"find_user_registrations":    {2, []int{4, 5, 7, 8}, false},
+	"find_pattern_registrations": {2, []int{4, 5, 7, 8}, false},
+	"find_stale_registrations":   {1, []int{4, 5, 7, 8}, false},
+}
+
+// Not every database compares a timestamp with 0
+var queryTestArgs = map[string][]interface{}{
+	"find_stale_registrations": {time.Unix(0, 0).UTC()},
+}
+
+//
+// Queries that xapsd does not know are left over from older versions
+// or misspelled. They are logged and removed, so that they are not
+// prepared either.
+//
+
+func removeUnknownQueries(queries map[string]string) {
+	names := []string{}
+	for name := range queries {
+		if _, ok := querySpecs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Ignoring unknown query '%s'", name)
+		delete(queries, name)
+	}
+}
+
+//
+// Check the configured queries against querySpecs. Queries that return
+// rows are run with dummy arguments, each in its own transaction that
+// is rolled back, to find out how many columns they return. Returns
+// every problem that was found.
+//
+
+func checkQueries(db *sqlStore, queries map[string]string) []string {
+	problems := []string{}
+
+	names := make([]string, 0, len(querySpecs))
+	for name := range querySpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		spec := querySpecs[name]
+		query, ok := queries[name]
+		if !ok {
+			if spec.required {
+				problems = append(problems, fmt.Sprintf("Query '%s' is missing", name))
+			}
+			continue
+		}
+
+		if params := countPlaceholders(query); params != spec.params {
+			problems = append(problems, fmt.Sprintf("Query '%s' has %d placeholders instead of %d", name, params, spec.params))
+			continue
+		}
+
+		stmt, ok := db.queries[name]
+		if !ok || spec.columns == nil {
+			continue
+		}
+
+		columns, err := testQuery(db.conn, stmt, testArgs(name))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Query '%s' failed: %v", name, err))
+			continue
+		}
+		if !containsInt(spec.columns, columns) {
+			problems = append(problems, fmt.Sprintf("Query '%s' returns %d columns instead of %s", name, columns, joinInts(spec.columns, " or ")))
+		}
+	}
+
+	return problems
+}
+
+func testArgs(name string) []interface{} {
+	if args, ok := queryTestArgs[name]; ok {
+		return args
+	}
+	args := make([]interface{}, querySpecs[name].params)
+	for i := range args {
+		args[i] = 0
+	}
+	return args
+}
+
+func testQuery(conn *sql.DB, stmt *sql.Stmt, args []interface{}) (int, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Stmt(stmt).Query(args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	return len(columns), err
+}
+
+func countPlaceholders(query string) int {
+	_, n := scanPlaceholders(query, func(int) string { return "?" })
+	return n
+}
+
+//
+// Call replace for every ? placeholder in a query and return the query
+// with the placeholders replaced, and the number of placeholders.
+// Question marks in string literals, quoted identifiers and comments
+// are not placeholders.
+//
+
+func scanPlaceholders(query string, replace func(n int) string) (string, int) {
+	var rebound strings.Builder
+	n := 0
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(query[i+1:], c)
+			if end == -1 {
+				rebound.WriteString(query[i:])
+				return rebound.String(), n
+			}
+			rebound.WriteString(query[i : i+end+2])
+			i += end + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end == -1 {
+				rebound.WriteString(query[i:])
+				return rebound.String(), n
+			}
+			rebound.WriteString(query[i : i+end])
+			i += end - 1
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end == -1 {
+				rebound.WriteString(query[i:])
+				return rebound.String(), n
+			}
+			rebound.WriteString(query[i : i+end+4])
+			i += end + 3
+		case c == '?':
+			n++
+			rebound.WriteString(replace(n))
+		default:
+			rebound.WriteByte(c)
+		}
+	}
+
+	return rebound.String(), n
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(values []int, sep string) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprint(v)
+	}
+	return strings.Join(s, sep)
+}
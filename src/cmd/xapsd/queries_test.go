@@ -0,0 +1,74 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_countPlaceholders(t *testing.T) {
+	if n := countPlaceholders(`SELECT id FROM t WHERE a = ? AND b = '?' AND c = ?`); n != 2 {
+		t.Error(`countPlaceholders != 2`, n)
+	}
+
+	if n := countPlaceholders("SELECT `a?` FROM t -- where x = ?"); n != 0 {
+		t.Error(`countPlaceholders != 0`, n)
+	}
+}
+
+func Test_checkQueries(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	defer func(queries map[string]SQLQueries) { Config.DB.Queries = queries }(Config.DB.Queries)
+	Config.DB.Queries = map[string]SQLQueries{
+		"find_registration":  {`SELECT r.id FROM xaps_registrations r WHERE r.account_id = ? AND r.device_token = ? AND r.subtopic = ?`},
+		"get_aps_mailboxes":  {`SELECT id, name FROM xaps_mailboxes WHERE registration_id = ? AND name = ?`},
+		"find_registrations": {`SELECT broken`},
+	}
+
+	_, err := connectDatabase(sqliteDialect)
+	if err == nil {
+		t.Fatal("connectDatabase accepted invalid queries")
+	}
+
+	for _, problem := range []string{
+		"Query 'find_registration' returns 1 columns instead of 3 or 4",
+		"Query 'get_aps_mailboxes' has 2 placeholders instead of 1",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Error does not contain %q: %v", problem, err)
+		}
+	}
+
+	if strings.Contains(err.Error(), "find_registrations") {
+		t.Error("Unknown query 'find_registrations' is a problem:", err)
+	}
+
+	if problems := checkQueries(db, standaloneQueries); len(problems) != 0 {
+		t.Error("checkQueries found problems in the standalone preset:", problems)
+	}
+}
@@ -0,0 +1,285 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+//
+// xapsd comes with a schema for its own tables, described as a list
+// of migrations for every SQL dialect. Versions mean the same thing in
+// every dialect. The versions that have been applied are kept in the
+// xaps_schema table, so that upgrading xapsd only applies the
+// migrations that are new.
+//
+// The sqlite driver applies migrations when it opens the database.
+// For MySQL and PostgreSQL they are applied with:
+//
+//  xapsd migrate up
+//
+
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+var sqliteMigrations = []migration{
+	{1, "Create users, registrations and mailboxes", []string{
+		`CREATE TABLE xaps_users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			local_part TEXT NOT NULL,
+			domain TEXT NOT NULL,
+			UNIQUE (local_part, domain)
+		)`,
+		`CREATE TABLE xaps_registrations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES xaps_users (id) ON DELETE CASCADE,
+			account_id TEXT NOT NULL,
+			device_token TEXT NOT NULL,
+			subtopic TEXT NOT NULL DEFAULT '',
+			UNIQUE (user_id, account_id, device_token)
+		)`,
+		`CREATE TABLE xaps_mailboxes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			registration_id INTEGER NOT NULL REFERENCES xaps_registrations (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			UNIQUE (registration_id, name)
+		)`,
+	}},
+	{2, "Add registration timestamps", []string{
+		`ALTER TABLE xaps_registrations ADD COLUMN created_at TIMESTAMP`,
+		`ALTER TABLE xaps_registrations ADD COLUMN last_registered_at TIMESTAMP`,
+		`UPDATE xaps_registrations SET created_at = CURRENT_TIMESTAMP, last_registered_at = CURRENT_TIMESTAMP`,
+	}},
+	{3, "Add encrypted registration values", []string{
+		`ALTER TABLE xaps_registrations ADD COLUMN sealed TEXT NOT NULL DEFAULT ''`,
+	}},
+}
+
+//
+// MySQL commits every DDL statement on its own, so the transaction of
+// a migration cannot undo the statements that ran before one that
+// failed. Tables are created with IF NOT EXISTS, so that the migration
+// can simply be run again. A migration that fails after an ALTER TABLE
+// has to be finished by hand: check the table against the statements
+// below and add the version to xaps_schema.
+//
+
+var mysqlMigrations = []migration{
+	{1, "Create users, registrations and mailboxes", []string{
+		`CREATE TABLE IF NOT EXISTS xaps_users (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			local_part VARCHAR(255) NOT NULL,
+			domain VARCHAR(255) NOT NULL,
+			UNIQUE KEY (local_part, domain)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS xaps_registrations (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			user_id INT UNSIGNED NOT NULL,
+			account_id VARCHAR(255) NOT NULL,
+			device_token VARCHAR(255) NOT NULL,
+			subtopic VARCHAR(255) NOT NULL DEFAULT '',
+			UNIQUE KEY (user_id, account_id, device_token),
+			FOREIGN KEY (user_id) REFERENCES xaps_users (id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS xaps_mailboxes (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			registration_id INT UNSIGNED NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			UNIQUE KEY (registration_id, name),
+			FOREIGN KEY (registration_id) REFERENCES xaps_registrations (id) ON DELETE CASCADE
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}},
+	{2, "Add registration timestamps", []string{
+		`ALTER TABLE xaps_registrations
+			ADD COLUMN created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			ADD COLUMN last_registered_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP`,
+	}},
+	{3, "Add encrypted registration values", []string{
+		`ALTER TABLE xaps_registrations ADD COLUMN sealed VARCHAR(1024) NOT NULL DEFAULT ''`,
+	}},
+}
+
+var postgresMigrations = []migration{
+	{1, "Create users, registrations and mailboxes", []string{
+		`CREATE TABLE xaps_users (
+			id SERIAL PRIMARY KEY,
+			local_part TEXT NOT NULL,
+			domain TEXT NOT NULL,
+			UNIQUE (local_part, domain)
+		)`,
+		`CREATE TABLE xaps_registrations (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES xaps_users (id) ON DELETE CASCADE,
+			account_id TEXT NOT NULL,
+			device_token TEXT NOT NULL,
+			subtopic TEXT NOT NULL DEFAULT '',
+			UNIQUE (user_id, account_id, device_token)
+		)`,
+		`CREATE TABLE xaps_mailboxes (
+			id SERIAL PRIMARY KEY,
+			registration_id INTEGER NOT NULL REFERENCES xaps_registrations (id) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			UNIQUE (registration_id, name)
+		)`,
+	}},
+	{2, "Add registration timestamps", []string{
+		`ALTER TABLE xaps_registrations
+			ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			ADD COLUMN last_registered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP`,
+	}},
+	{3, "Add encrypted registration values", []string{
+		`ALTER TABLE xaps_registrations ADD COLUMN sealed TEXT NOT NULL DEFAULT ''`,
+	}},
+}
+
+func createSchemaTable(conn *sql.DB) error {
+	_, err := conn.Exec(`CREATE TABLE IF NOT EXISTS xaps_schema (version INTEGER NOT NULL PRIMARY KEY, description VARCHAR(255) NOT NULL)`)
+	return err
+}
+
+//
+// Return the version of the schema in the database. A database that
+// has no xaps_schema table does not have the schema at all, which is
+// reported as version 0.
+//
+
+func schemaVersion(conn *sql.DB) (int, error) {
+	var version int
+	err := conn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM xaps_schema`).Scan(&version)
+	if err != nil {
+		var exists int
+		if conn.QueryRow(`SELECT COUNT(*) FROM xaps_schema`).Scan(&exists) != nil {
+			return 0, nil
+		}
+	}
+	return version, err
+}
+
+func migrateSchema(conn *sql.DB, dialect *sqlDialect) error {
+	if err := createSchemaTable(conn); err != nil {
+		return fmt.Errorf("Cannot create xaps_schema table: %v", err)
+	}
+
+	version, err := schemaVersion(conn)
+	if err != nil {
+		return fmt.Errorf("Cannot determine schema version: %v", err)
+	}
+
+	insert := `INSERT INTO xaps_schema (version, description) VALUES (?, ?)`
+	if dialect.rebind != nil {
+		insert = dialect.rebind(insert)
+	}
+
+	for _, m := range dialect.migrations {
+		if m.version <= version {
+			continue
+		}
+
+		log.Printf("Migrating schema to version %d: %s", m.version, m.description)
+
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range m.statements {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Migration to schema version %d failed: %v", m.version, err)
+			}
+		}
+
+		_, err = tx.Exec(insert, m.version, m.description)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Run the migrate subcommand:
+//
+//  xapsd migrate status
+//  xapsd migrate up
+//
+// Status shows which migrations have been applied to the configured
+// database and up applies the ones that are missing.
+//
+
+func runMigrate(config string, args []string) error {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		return usageError("migrate status", "migrate up")
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+
+	dialect, ok := sqlDialects[Config.Storage.Driver]
+	if !ok {
+		return fmt.Errorf("The %s storage driver does not use a database schema", Config.Storage.Driver)
+	}
+
+	conn, err := openConnection(dialect.driver, dialect.dsn())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if args[0] == "up" {
+		if err := migrateSchema(conn, dialect); err != nil {
+			return err
+		}
+	}
+
+	version, err := schemaVersion(conn)
+	if err != nil {
+		return err
+	}
+
+	latest := dialect.migrations[len(dialect.migrations)-1].version
+	fmt.Printf("Schema version %d of %d\n\n", version, latest)
+	for _, m := range dialect.migrations {
+		state := "pending"
+		if m.version <= version {
+			state = "applied"
+		}
+		fmt.Printf("  %-8s %3d  %s\n", state, m.version, m.description)
+	}
+
+	return nil
+}
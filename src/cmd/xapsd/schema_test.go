@@ -0,0 +1,73 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+func Test_migrateSchema(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	version, err := schemaVersion(db.conn)
+	if err != nil {
+		t.Error("Cannot schemaVersion:", err)
+	}
+	if version != sqliteMigrations[len(sqliteMigrations)-1].version {
+		t.Error("Schema is not at the latest version", version)
+	}
+
+	// Migrating again does nothing
+	if err := migrateSchema(db.conn, sqliteDialect); err != nil {
+		t.Error("Cannot migrateSchema twice:", err)
+	}
+
+	// Descriptions are bound as parameters
+	dialect := *sqliteDialect
+	dialect.migrations = append(append([]migration(nil), sqliteMigrations...),
+		migration{version + 1, "Add the user's notes", []string{`CREATE TABLE xaps_notes (id INTEGER PRIMARY KEY)`}})
+	if err := migrateSchema(db.conn, &dialect); err != nil {
+		t.Error("Cannot migrateSchema with a quote in the description:", err)
+	}
+	var description string
+	if err := db.conn.QueryRow(`SELECT description FROM xaps_schema WHERE version = ?`, version+1).Scan(&description); err != nil || description != "Add the user's notes" {
+		t.Error(`description != "Add the user's notes"`, description, err)
+	}
+}
+
+func Test_migrations_AreTheSameForAllDialects(t *testing.T) {
+	for name, dialect := range sqlDialects {
+		if len(dialect.migrations) != len(sqliteMigrations) {
+			t.Errorf("%s has %d migrations instead of %d", name, len(dialect.migrations), len(sqliteMigrations))
+			continue
+		}
+		for i, m := range dialect.migrations {
+			if m.version != sqliteMigrations[i].version || m.description != sqliteMigrations[i].description {
+				t.Errorf("%s migration %d is %d %q instead of %d %q", name, i, m.version, m.description, sqliteMigrations[i].version, sqliteMigrations[i].description)
+			}
+		}
+	}
+}
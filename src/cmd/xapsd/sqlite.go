@@ -0,0 +1,45 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//
+// The sqlite storage driver keeps registrations in a SQLite database
+// file. It creates and upgrades its own tables and uses the standalone
+// query preset, so it needs no configuration besides the path.
+//
+
+var sqliteDialect = &sqlDialect{driver: "sqlite3", dsn: sqliteDSN, migrations: sqliteMigrations, autoMigrate: true, queries: standaloneQueries}
+
+func init() {
+	registerSQLDialect("sqlite", sqliteDialect)
+}
+
+func sqliteDSN() string {
+	return "file:" + Config.Storage.SQLite + "?_foreign_keys=1&_busy_timeout=5000&_journal_mode=WAL"
+}
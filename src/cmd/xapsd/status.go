@@ -0,0 +1,81 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type statusValue struct {
+	name  string
+	value string
+}
+
+//
+// Values can contain error messages from the storage, so quotes and
+// the characters that separate pairs and responses are escaped.
+//
+
+var statusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\t", `\t`, "\n", `\n`)
+
+func formatStatus(values []statusValue) string {
+	pairs := make([]string, 0, len(values))
+	for _, value := range values {
+		pairs = append(pairs, value.name+`="`+statusEscaper.Replace(value.value)+`"`)
+	}
+	return strings.Join(pairs, "\t")
+}
+
+//
+// Handle the STATUS command. It takes no arguments and returns the
+// state of the daemon as name/value pairs in the same format that is
+// used for command arguments:
+//
+//  OK version="2.4.0" identity-mail-topic="com.apple.mail.XServer.x"
+//     identity-mail-expires="2027-01-01T00:00:00Z"
+//     identity-mail-days-to-expiry="75" storage-available="true"
+//     storage-since="2026-01-01T00:00:00Z"
+//
+
+func handleStatus(conn net.Conn, identities *pushIdentities, db registrationStore) {
+	now := time.Now()
+
+	status := []statusValue{{"version", Version}}
+	for _, identity := range identities.all {
+		_, leaf := identity.current()
+		prefix := "identity-" + identity.name + "-"
+		status = append(status,
+			statusValue{prefix + "topic", identity.topic},
+			statusValue{prefix + "expires", leaf.NotAfter.UTC().Format(time.RFC3339)},
+			statusValue{prefix + "days-to-expiry", strconv.Itoa(daysToExpiry(leaf, now))})
+	}
+
+	status = append(status, db.status()...)
+
+	writeSuccess(conn, formatStatus(status))
+}
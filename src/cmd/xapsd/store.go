@@ -0,0 +1,285 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Registration struct {
+	DbId        int
+	Username    string
+	DeviceToken string
+	AccountId   string
+	Subtopic    string
+	Mailboxes   []string
+
+	// With encryption the account id and device token are lookup
+	// hashes and Sealed holds the encrypted values, see encryption.go
+	Sealed string
+
+	Created        time.Time
+	LastRegistered time.Time
+}
+
+//
+// A registration store remembers which devices want to be notified
+// about which mailboxes. The handlers only talk to this interface;
+// the backend is selected with Config.Storage.Driver.
+//
+
+type registrationStore interface {
+	addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error
+	importRegistration(reg Registration) error
+	findRegistrations(username, mailbox string) ([]Registration, error)
+	findTokenRegistrations(deviceToken string) ([]Registration, error)
+	userRegistrations(username string) ([]Registration, error)
+	patternRegistrations(username string) ([]Registration, error)
+	deleteRegistration(reg Registration) error
+	listRegistrations() ([]Registration, error)
+	expireRegistrations(before time.Time) ([]Registration, error)
+	status() []statusValue
+	close() error
+}
+
+//
+// The storage drivers can also report the registration that a REGISTER
+// replaced, with its mailboxes, or nil for a new registration. The
+// audit trail uses this instead of looking the registration up first.
+// register takes the times like importRegistration.
+//
+
+type registeringStore interface {
+	registrationStore
+	register(reg Registration) (*Registration, error)
+}
+
+var storageDrivers = make(map[string]func() (registrationStore, error))
+
+//
+// Make a storage backend available under the given name. Backends
+// call this from their init function, like database/sql drivers do.
+//
+
+func registerStorageDriver(name string, open func() (registrationStore, error)) {
+	if _, ok := storageDrivers[name]; ok {
+		panic("registerStorageDriver called twice for storage driver " + name)
+	}
+	storageDrivers[name] = open
+}
+
+func openStore() (registrationStore, error) {
+	open, ok := storageDrivers[Config.Storage.Driver]
+	if !ok {
+		names := make([]string, 0, len(storageDrivers))
+		for name := range storageDrivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("Unknown storage driver '%s', available are: %s", Config.Storage.Driver, strings.Join(names, ", "))
+	}
+
+	normalizer, err := newUsernameNormalizer()
+	if err != nil {
+		return nil, err
+	}
+
+	checkInterval, err := time.ParseDuration(Config.Storage.HealthCheckInterval)
+	if err != nil || checkInterval <= 0 {
+		return nil, fmt.Errorf("Invalid HealthCheckInterval '%s'", Config.Storage.HealthCheckInterval)
+	}
+	maxBackoff, err := time.ParseDuration(Config.Storage.ReconnectMaxBackoff)
+	if err != nil || maxBackoff <= 0 {
+		return nil, fmt.Errorf("Invalid ReconnectMaxBackoff '%s'", Config.Storage.ReconnectMaxBackoff)
+	}
+
+	if Config.Storage.EncryptionKeyFile != "" {
+		key, err := readEncryptionKey(Config.Storage.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cipher, err := newTokenCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		openDriver := open
+		open = func() (registrationStore, error) {
+			store, err := openDriver()
+			if err != nil {
+				return nil, err
+			}
+			return &encryptingStore{store, cipher}, nil
+		}
+	}
+
+	// The audit trail sits right above the driver, which knows what a
+	// REGISTER replaced
+	if Config.Audit.File != "" {
+		openUnaudited := open
+		open = func() (registrationStore, error) {
+			store, err := openUnaudited()
+			if err != nil {
+				return nil, err
+			}
+			registering, ok := store.(registeringStore)
+			if !ok {
+				store.close()
+				return nil, fmt.Errorf("The %s storage driver does not support an audit trail", Config.Storage.Driver)
+			}
+			return &auditingStore{registering}, nil
+		}
+	}
+
+	// Start without the store if it cannot be reached, but not if
+	// it is misconfigured
+	first, err := open()
+	if err != nil && !isUnavailable(err) {
+		return nil, err
+	}
+	var store registrationStore = newHealthStore(open, first, err, checkInterval, maxBackoff)
+
+	if Config.Mailboxes.Patterns {
+		store = &patternStore{store, Config.Mailboxes.Delimiter}
+	}
+
+	if Config.Storage.CacheSize > 0 {
+		ttl, err := time.ParseDuration(Config.Storage.CacheTTL)
+		if err != nil || ttl <= 0 {
+			store.close()
+			return nil, fmt.Errorf("Invalid CacheTTL '%s'", Config.Storage.CacheTTL)
+		}
+		store = newCachingStore(store, Config.Storage.CacheSize, ttl)
+	}
+
+	switch Config.Storage.DuplicateTokens {
+	case "", duplicateTokensKeep:
+	case duplicateTokensLatest:
+		store = &dedupingStore{store}
+	default:
+		store.close()
+		return nil, fmt.Errorf("Invalid DuplicateTokens '%s', must be keep or latest", Config.Storage.DuplicateTokens)
+	}
+
+	if Config.Limits.DevicesPerUser > 0 || Config.Limits.MailboxesPerRegistration > 0 {
+		store = &limitingStore{registrationStore: store, byAccount: Config.Storage.Driver == "file"}
+	}
+
+	return &normalizingStore{store, normalizer}, nil
+}
+
+//
+// Delete registrations that have not been refreshed within
+// Config.Storage.ExpireAfter, at startup and then periodically.
+// Devices register again whenever they connect, so only devices that
+// are gone, for example wiped phones, stop being refreshed.
+//
+
+func expireRegistrations(db registrationStore) {
+	if Config.Storage.ExpireAfter == "" {
+		return
+	}
+
+	ttl, err := time.ParseDuration(Config.Storage.ExpireAfter)
+	if err != nil || ttl <= 0 {
+		log.Println("Invalid ExpireAfter, not expiring registrations: ", Config.Storage.ExpireAfter)
+		return
+	}
+	interval, err := time.ParseDuration(Config.Storage.ExpireCheckInterval)
+	if err != nil || interval <= 0 {
+		log.Println("Invalid ExpireCheckInterval, not expiring registrations: ", Config.Storage.ExpireCheckInterval)
+		return
+	}
+
+	go func() {
+		for {
+			expireStaleRegistrations(db, time.Now().Add(-ttl))
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func expireStaleRegistrations(db registrationStore, before time.Time) {
+	expired, err := db.expireRegistrations(before)
+	if err != nil {
+		log.Println("Cannot expire registrations: ", err)
+		return
+	}
+
+	for _, reg := range expired {
+		recordAudit(auditExpired, reg, "last registered "+reg.LastRegistered.Format(time.RFC3339))
+		log.Printf("Expired registration of %s for account %s, device %s, last registered %s", reg.Username, auditPrefix(reg.AccountId), auditPrefix(reg.DeviceToken), reg.LastRegistered.Format(time.RFC3339))
+	}
+}
+
+//
+// A keyedMutex hands out a mutex per key, for example to serialize
+// changes to the registrations of a single user.
+//
+
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+//
+// Lock the mutex for key and return the function that unlocks it.
+//
+
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
@@ -0,0 +1,93 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_openStore_UnknownDriver(t *testing.T) {
+	defer func(driver string) { Config.Storage.Driver = driver }(Config.Storage.Driver)
+
+	Config.Storage.Driver = "doesnotexist"
+	if _, err := openStore(); err == nil {
+		t.Error(`openStore() did not fail for driver "doesnotexist"`)
+	}
+}
+
+func Test_registerStorageDriver(t *testing.T) {
+	if _, ok := storageDrivers["mysql"]; !ok {
+		t.Error(`storageDrivers["mysql"] is not registered`)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error(`registerStorageDriver("mysql") twice did not panic`)
+		}
+	}()
+	registerStorageDriver("mysql", nil)
+}
+
+func Test_keyedMutex(t *testing.T) {
+	var locks keyedMutex
+	var order []string
+
+	unlock := locks.lock("alice")
+
+	done := make(chan bool)
+	go func() {
+		unlock := locks.lock("alice")
+		order = append(order, "second")
+		unlock()
+		done <- true
+	}()
+
+	// Wait until the second lock for alice is waiting
+	for i, waiting := 0, false; i < 1000 && !waiting; i++ {
+		time.Sleep(time.Millisecond)
+		locks.mu.Lock()
+		waiting = locks.locks["alice"].refs == 2
+		locks.mu.Unlock()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// A different key does not wait for alice
+	locks.lock("bob")()
+
+	order = append(order, "first")
+	unlock()
+	<-done
+
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Error("Second lock for alice did not wait", order)
+	}
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	if len(locks.locks) != 0 {
+		t.Error("keyedMutex did not forget unused keys", locks.locks)
+	}
+}
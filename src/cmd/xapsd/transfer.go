@@ -0,0 +1,281 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+//
+// Registrations can be exported to a file and imported again, to move
+// them to another storage backend, to make backups or to seed a test
+// setup. Both JSON and CSV are supported. In CSV files the mailboxes
+// of a registration are separated by newlines, which cannot appear in
+// IMAP mailbox names. Times are in RFC 3339 format.
+//
+
+type exportedRegistration struct {
+	Username       string   `json:"username"`
+	AccountId      string   `json:"account-id"`
+	DeviceToken    string   `json:"device-token"`
+	Subtopic       string   `json:"subtopic,omitempty"`
+	Mailboxes      []string `json:"mailboxes"`
+	Created        string   `json:"created,omitempty"`
+	LastRegistered string   `json:"last-registered,omitempty"`
+}
+
+var csvHeader = []string{"username", "account-id", "device-token", "subtopic", "mailboxes", "created", "last-registered"}
+
+func exportRegistration(reg Registration) exportedRegistration {
+	return exportedRegistration{
+		Username:       reg.Username,
+		AccountId:      reg.AccountId,
+		DeviceToken:    reg.DeviceToken,
+		Subtopic:       reg.Subtopic,
+		Mailboxes:      reg.Mailboxes,
+		Created:        formatExportTime(reg.Created),
+		LastRegistered: formatExportTime(reg.LastRegistered),
+	}
+}
+
+func (e exportedRegistration) registration() (Registration, error) {
+	reg := Registration{
+		Username:    e.Username,
+		AccountId:   e.AccountId,
+		DeviceToken: e.DeviceToken,
+		Subtopic:    e.Subtopic,
+		Mailboxes:   e.Mailboxes,
+	}
+	if reg.Username == "" || reg.AccountId == "" || reg.DeviceToken == "" {
+		return reg, fmt.Errorf("Registration without username, account-id or device-token")
+	}
+
+	var err error
+	if reg.Created, err = parseExportTime(e.Created); err != nil {
+		return reg, err
+	}
+	if reg.LastRegistered, err = parseExportTime(e.LastRegistered); err != nil {
+		return reg, err
+	}
+	return reg, nil
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseExportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("Invalid time '%s'", value)
+	}
+	return t, nil
+}
+
+func writeRegistrations(w io.Writer, format string, registrations []Registration) error {
+	switch format {
+	case "json":
+		exported := make([]exportedRegistration, 0, len(registrations))
+		for _, reg := range registrations {
+			exported = append(exported, exportRegistration(reg))
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(exported)
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(csvHeader)
+		for _, reg := range registrations {
+			e := exportRegistration(reg)
+			writer.Write([]string{e.Username, e.AccountId, e.DeviceToken, e.Subtopic, strings.Join(e.Mailboxes, "\n"), e.Created, e.LastRegistered})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("Unknown format '%s'", format)
+}
+
+func readRegistrations(r io.Reader, format string) ([]Registration, error) {
+	var exported []exportedRegistration
+
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&exported); err != nil {
+			return nil, fmt.Errorf("Cannot read registrations: %v", err)
+		}
+	case "csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = len(csvHeader)
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read registrations: %v", err)
+		}
+		if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(csvHeader, ",") {
+			return nil, fmt.Errorf("The first line must be the header %s", strings.Join(csvHeader, ","))
+		}
+		for _, record := range records[1:] {
+			e := exportedRegistration{Username: record[0], AccountId: record[1], DeviceToken: record[2], Subtopic: record[3], Created: record[5], LastRegistered: record[6]}
+			e.Mailboxes = []string{}
+			if record[4] != "" {
+				e.Mailboxes = strings.Split(record[4], "\n")
+			}
+			exported = append(exported, e)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown format '%s'", format)
+	}
+
+	registrations := make([]Registration, 0, len(exported))
+	for i, e := range exported {
+		reg, err := e.registration()
+		if err != nil {
+			return nil, fmt.Errorf("Registration %d: %v", i+1, err)
+		}
+		registrations = append(registrations, reg)
+	}
+	return registrations, nil
+}
+
+//
+// The format is json unless the file name ends in .csv or another
+// format is given with -format.
+//
+
+func parseTransferArgs(name string, args []string) (string, string, error) {
+	usage := usageError(name + " [-format json|csv] [file]")
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	format := flags.String("format", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return "", "", usage
+	}
+
+	file := flags.Arg(0)
+	if *format == "" {
+		*format = "json"
+		if strings.HasSuffix(file, ".csv") {
+			*format = "csv"
+		}
+	}
+	if *format != "json" && *format != "csv" {
+		return "", "", usage
+	}
+
+	return file, *format, nil
+}
+
+func runExport(config string, args []string) error {
+	file, format, err := parseTransferArgs("export", args)
+	if err != nil {
+		return err
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	registrations, err := db.listRegistrations()
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if file != "" {
+		if out, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return err
+		}
+	}
+	if err := writeRegistrations(out, format, registrations); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d registrations\n", len(registrations))
+	return nil
+}
+
+func runImport(config string, args []string) error {
+	file, format, err := parseTransferArgs("import", args)
+	if err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if file != "" {
+		if in, err = os.Open(file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	// Read everything first, so that a broken file imports nothing
+	registrations, err := readRegistrations(in, format)
+	if err != nil {
+		return err
+	}
+
+	if err := loadConfig(config); err != nil {
+		return err
+	}
+
+	db, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	for i, reg := range registrations {
+		if err := db.importRegistration(reg); err != nil {
+			return fmt.Errorf("Imported %d of %d registrations, cannot import %s/%s: %v", i, len(registrations), reg.Username, reg.AccountId, err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported %d registrations\n", len(registrations))
+	return nil
+}
@@ -0,0 +1,134 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testExport = []Registration{
+	{
+		Username:       "stefan@example.com",
+		AccountId:      "testaccountid1",
+		DeviceToken:    "testtoken1",
+		Subtopic:       "com.apple.mobilemail",
+		Mailboxes:      []string{"Inbox", "Lists, Go"},
+		Created:        time.Date(2020, 5, 17, 12, 30, 0, 0, time.UTC),
+		LastRegistered: time.Date(2020, 6, 1, 8, 0, 0, 0, time.UTC),
+	},
+	{
+		Username:    "alice",
+		AccountId:   "testaccountid2",
+		DeviceToken: "testtoken2",
+		Mailboxes:   []string{},
+	},
+}
+
+func Test_writeRegistrations_RoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "csv"} {
+		var buf bytes.Buffer
+		if err := writeRegistrations(&buf, format, testExport); err != nil {
+			t.Error("Cannot write", format, err)
+		}
+
+		registrations, err := readRegistrations(&buf, format)
+		if err != nil {
+			t.Error("Cannot read", format, err)
+		}
+		if !reflect.DeepEqual(registrations, testExport) {
+			t.Errorf("%s round trip returned %v", format, registrations)
+		}
+	}
+}
+
+func Test_readRegistrations_Invalid(t *testing.T) {
+	if _, err := readRegistrations(bytes.NewBufferString(`[{"username": "stefan"}]`), "json"); err == nil {
+		t.Error("readRegistrations accepted a registration without a device token")
+	}
+	if _, err := readRegistrations(bytes.NewBufferString("stefan,id,token,,Inbox,,\n"), "csv"); err == nil {
+		t.Error("readRegistrations accepted a CSV file without a header")
+	}
+	if _, err := readRegistrations(bytes.NewBufferString(`[{"username": "stefan", "account-id": "id", "device-token": "token", "created": "yesterday"}]`), "json"); err == nil {
+		t.Error("readRegistrations accepted an invalid time")
+	}
+}
+
+func Test_parseTransferArgs(t *testing.T) {
+	if file, format, err := parseTransferArgs("export", []string{"backup.csv"}); err != nil || file != "backup.csv" || format != "csv" {
+		t.Error(`parseTransferArgs("backup.csv") =`, file, format, err)
+	}
+	if file, format, err := parseTransferArgs("export", []string{"-format", "csv"}); err != nil || file != "" || format != "csv" {
+		t.Error(`parseTransferArgs("-format csv") =`, file, format, err)
+	}
+	if _, format, err := parseTransferArgs("export", nil); err != nil || format != "json" {
+		t.Error(`parseTransferArgs() =`, format, err)
+	}
+	if _, _, err := parseTransferArgs("export", []string{"-format", "xml"}); err == nil {
+		t.Error(`parseTransferArgs("-format xml") did not fail`)
+	}
+}
+
+func Test_importRegistration(t *testing.T) {
+	f, err := ioutil.TempFile("/tmp", "transfer_test_Test_importRegistration")
+	if err != nil {
+		t.Error("Can't create temporary file", err)
+	}
+	defer os.Remove(f.Name())
+	defer os.Remove(f.Name() + ".lock")
+
+	file, err := newDatabase(f.Name())
+	if err != nil {
+		t.Error("Cannot open database", err)
+	}
+	sqlite, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	for _, db := range []registrationStore{file, sqlite} {
+		for _, reg := range testExport {
+			if err := db.importRegistration(reg); err != nil {
+				t.Error("Cannot importRegistration:", err)
+			}
+		}
+
+		registrations, err := db.listRegistrations()
+		if err != nil || len(registrations) != 2 {
+			t.Fatal("Cannot listRegistrations:", registrations, err)
+		}
+
+		// Sorted by username
+		reg := registrations[1]
+		if reg.Username != "stefan@example.com" || !reg.Created.Equal(testExport[0].Created) || !reg.LastRegistered.Equal(testExport[0].LastRegistered) {
+			t.Errorf("%T did not keep the registration times: %v", db, reg)
+		}
+		if registrations[0].LastRegistered.IsZero() {
+			t.Errorf("%T did not set a registration time: %v", db, registrations[0])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type UsernameRewrite struct {
+	Match   string
+	Replace string
+}
+
+//
+// Dovecot usernames are normalized before they are used as keys in
+// the store, so that variations of the same name end up with the same
+// registrations. The steps run in this order: lowercasing, stripping
+// the sub-address, adding the default domain, the regex rewrites and
+// finally the lookup table.
+//
+
+type usernameNormalizer struct {
+	lowercase       bool
+	detailDelimiter string
+	defaultDomain   string
+	rewrites        []usernameRewrite
+	table           map[string]string
+}
+
+type usernameRewrite struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+func newUsernameNormalizer() (*usernameNormalizer, error) {
+	n := &usernameNormalizer{
+		lowercase:     Config.Users.Lowercase,
+		defaultDomain: Config.Users.DefaultDomain,
+	}
+	if Config.Users.StripDetail {
+		n.detailDelimiter = Config.Users.DetailDelimiter
+	}
+
+	for _, rewrite := range Config.Users.Rewrite {
+		match, err := regexp.Compile(rewrite.Match)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid username rewrite '%s': %v", rewrite.Match, err)
+		}
+		n.rewrites = append(n.rewrites, usernameRewrite{match, rewrite.Replace})
+	}
+
+	if Config.Users.MapFile != "" {
+		table, err := readUsernameMap(Config.Users.MapFile)
+		if err != nil {
+			return nil, err
+		}
+		n.table = table
+	}
+
+	return n, nil
+}
+
+//
+// The lookup table has a Dovecot username and the key to store its
+// registrations under on each line, separated by whitespace. Empty
+// lines and lines that start with # are ignored.
+//
+
+func readUsernameMap(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read username map: %v", err)
+	}
+	defer f.Close()
+
+	table := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid line %d in username map %s: expected a username and a key", line, path)
+		}
+		table[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read username map: %v", err)
+	}
+
+	return table, nil
+}
+
+func (n *usernameNormalizer) normalize(username string) string {
+	if n.lowercase {
+		username = strings.ToLower(username)
+	}
+
+	if n.detailDelimiter != "" {
+		local, domain := splitUsername(username)
+		if i := strings.Index(local, n.detailDelimiter); i > 0 {
+			username = local[:i]
+			if domain != "" {
+				username += "@" + domain
+			}
+		}
+	}
+
+	if n.defaultDomain != "" && !strings.Contains(username, "@") {
+		username += "@" + n.defaultDomain
+	}
+
+	for _, rewrite := range n.rewrites {
+		username = rewrite.match.ReplaceAllString(username, rewrite.replace)
+	}
+
+	if key, ok := n.table[username]; ok {
+		username = key
+	}
+
+	return username
+}
+
+//
+// Split a username in the local part and the domain. Usernames
+// without a domain have an empty domain.
+//
+
+func splitUsername(username string) (string, string) {
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		return username[:i], username[i+1:]
+	}
+	return username, ""
+}
+
+//
+// A normalizingStore normalizes the usernames that are passed to the
+// store it wraps, so REGISTER and NOTIFY use the same keys.
+//
+
+type normalizingStore struct {
+	registrationStore
+	normalizer *usernameNormalizer
+}
+
+func (s *normalizingStore) addRegistration(username, accountId, deviceToken, subtopic string, mailboxes []string) error {
+	username = s.normalizer.normalize(username)
+	if *debug {
+		log.Println("[DEBUG] Normalized username:", username)
+	}
+	return s.registrationStore.addRegistration(username, accountId, deviceToken, subtopic, mailboxes)
+}
+
+func (s *normalizingStore) importRegistration(reg Registration) error {
+	reg.Username = s.normalizer.normalize(reg.Username)
+	return s.registrationStore.importRegistration(reg)
+}
+
+func (s *normalizingStore) findRegistrations(username, mailbox string) ([]Registration, error) {
+	return s.registrationStore.findRegistrations(s.normalizer.normalize(username), mailbox)
+}
+
+func (s *normalizingStore) userRegistrations(username string) ([]Registration, error) {
+	return s.registrationStore.userRegistrations(s.normalizer.normalize(username))
+}
+
+func (s *normalizingStore) patternRegistrations(username string) ([]Registration, error) {
+	return s.registrationStore.patternRegistrations(s.normalizer.normalize(username))
+}
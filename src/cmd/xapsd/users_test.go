@@ -0,0 +1,138 @@
+//
+// The MIT License (MIT)
+//
+// Copyright (c) 2015 Stefan Arentz <stefan@arentz.ca>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_usernameNormalizer(t *testing.T) {
+	n := &usernameNormalizer{
+		lowercase:       true,
+		detailDelimiter: "+",
+		defaultDomain:   "example.com",
+		table:           map[string]string{"postmaster@example.com": "stefan@example.com"},
+	}
+
+	tests := map[string]string{
+		"stefan@example.com":       "stefan@example.com",
+		"Stefan@Example.COM":       "stefan@example.com",
+		"stefan+lists@example.com": "stefan@example.com",
+		"stefan":                   "stefan@example.com",
+		"stefan+lists":             "stefan@example.com",
+		"+lists@example.com":       "+lists@example.com",
+		"postmaster":               "stefan@example.com",
+		"other@example.org":        "other@example.org",
+	}
+	for username, expected := range tests {
+		if normalized := n.normalize(username); normalized != expected {
+			t.Errorf("normalize(%q) = %q, expected %q", username, normalized, expected)
+		}
+	}
+}
+
+func Test_usernameNormalizer_Rewrite(t *testing.T) {
+	Config.Users.Rewrite = []UsernameRewrite{{Match: `^(.*)@mail\.example\.com$`, Replace: "$1@example.com"}}
+	defer func() { Config.Users.Rewrite = nil }()
+
+	n, err := newUsernameNormalizer()
+	if err != nil {
+		t.Fatal("Cannot create normalizer:", err)
+	}
+	if normalized := n.normalize("stefan@mail.example.com"); normalized != "stefan@example.com" {
+		t.Error(`normalize("stefan@mail.example.com") =`, normalized)
+	}
+	if normalized := n.normalize("Stefan"); normalized != "Stefan" {
+		t.Error(`normalize("Stefan") changed a username without any configuration:`, normalized)
+	}
+
+	Config.Users.Rewrite = []UsernameRewrite{{Match: `(`}}
+	if _, err := newUsernameNormalizer(); err == nil {
+		t.Error("newUsernameNormalizer accepted an invalid regex")
+	}
+}
+
+func Test_readUsernameMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users_test")
+	if err != nil {
+		t.Fatal("Can't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "users.map")
+	ioutil.WriteFile(path, []byte("# Dovecot username  store key\n\nstefan   stefan@example.com\nsa\tstefan@example.com\n"), 0644)
+
+	table, err := readUsernameMap(path)
+	if err != nil {
+		t.Fatal("Cannot read username map:", err)
+	}
+	if len(table) != 2 || table["stefan"] != "stefan@example.com" || table["sa"] != "stefan@example.com" {
+		t.Error("readUsernameMap returned", table)
+	}
+
+	ioutil.WriteFile(path, []byte("stefan\n"), 0644)
+	if _, err := readUsernameMap(path); err == nil {
+		t.Error("readUsernameMap accepted a line without a key")
+	}
+}
+
+func Test_splitUsername(t *testing.T) {
+	if local, domain := splitUsername("stefan@example.com"); local != "stefan" || domain != "example.com" {
+		t.Error(`splitUsername("stefan@example.com") =`, local, domain)
+	}
+	if local, domain := splitUsername("stefan"); local != "stefan" || domain != "" {
+		t.Error(`splitUsername("stefan") =`, local, domain)
+	}
+}
+
+func Test_normalizingStore(t *testing.T) {
+	db, cleanup := openTestDatabase(t)
+	defer cleanup()
+
+	store := &normalizingStore{db, &usernameNormalizer{lowercase: true, detailDelimiter: "+"}}
+
+	if err := store.addRegistration("Test+Phone@Example.com", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Fatal("Cannot addRegistration:", err)
+	}
+
+	registrations, err := store.findRegistrations("test@EXAMPLE.com", "Inbox")
+	if err != nil {
+		t.Error("Cannot findRegistrations:", err)
+	}
+	if len(registrations) != 1 || registrations[0].Username != "test@example.com" {
+		t.Error("findRegistrations did not find the normalized registration", registrations)
+	}
+
+	// Usernames without a domain used to crash the SQL store
+	if err := store.addRegistration("test", "testaccountid", "testtoken", "com.apple.mobilemail", []string{"Inbox"}); err != nil {
+		t.Error("Cannot addRegistration without a domain:", err)
+	}
+	if registrations, _ := store.findRegistrations("test", "Inbox"); len(registrations) != 1 {
+		t.Error("findRegistrations without a domain returned", registrations)
+	}
+}
@@ -31,8 +31,6 @@ import (
 	"flag"
 	"encoding/json"
         "github.com/sideshow/apns2"
-	"github.com/sideshow/apns2/certificate"
-	"github.com/jinzhu/configor"
 	"log"
 	"net"
 	"os"
@@ -70,6 +68,9 @@ func (cmd *command) getListArg(name string) ([]string, bool) {
 
 func parseListValue(value string) ([]string, error) {
 	list := []string{}
+	if value == "()" {
+		return list, nil
+	}
 	values := strings.Split(value[1:len(value)-1], ",")
 	for _, value := range values {
 		stringValue, err := parseStringValue(value)
@@ -89,12 +90,17 @@ func parseCommand(line string) (command, error) {
 	cmd := command{args: make(map[string]interface{})}
 
 	parts := strings.SplitN(line, " ", 2)
-	if len(parts) != 2 {
+	if parts[0] == "" {
 		return cmd, errors.New("Failed to parse: no name found")
 	}
 
 	cmd.name = parts[0]
 
+	// Commands like STATUS do not take any arguments
+	if len(parts) == 1 {
+		return cmd, nil
+	}
+
 	for _, pair := range strings.Split(parts[1], "\t") {
 		nameAndValue := strings.SplitN(pair, "=", 2)
 		if len(nameAndValue) != 2 {
@@ -123,6 +129,7 @@ func parseCommand(line string) (command, error) {
 }
 
 var debug = flag.Bool("debug", false, "enable debug logging")
+var certfile = flag.String("certificate", "", "path to the pem/p12 file containing the key and certificate")
 
 func topicFromCertificate(cert *x509.Certificate) (string, error) {
 	if len(cert.Subject.Names) == 0 {
@@ -148,18 +155,84 @@ type SQLQueries struct {
     Sql	string
 }
 
+type IdentityConfig struct {
+	Certificate string
+	Subtopics   []string
+}
+
 var Config = struct {
 	Certificate string `default:"/etc/xapsd/certificate.pem"`
 	Socket      string `default:"/var/run/xapsd/xapsd.sock"`
 
+	Identities map[string]IdentityConfig
+
+	APNS struct {
+		Proxy         string
+		ProxyUser     string
+		ProxyPassword string
+
+		ExpiryWarnings          []int  `default:"[30,14,7]"`
+		ExpiryCheckInterval     string `default:"12h"`
+		AllowExpiredCertificate bool
+		ReloadCheckInterval     string `default:"1m"`
+	}
+
+	Users struct {
+		Lowercase       bool
+		DefaultDomain   string
+		StripDetail     bool
+		DetailDelimiter string `default:"+"`
+		Rewrite         []UsernameRewrite
+		MapFile         string
+	}
+
+	Mailboxes struct {
+		Patterns  bool
+		Delimiter string `default:"/"`
+		Default   []string
+	}
+
+	Limits struct {
+		DevicesPerUser           int
+		MailboxesPerRegistration int
+		DevicePolicy             string `default:"reject"`
+	}
+
+	Audit struct {
+		File string
+	}
+
+	Storage struct {
+		Driver string `default:"mysql"`
+		File   string `default:"/var/lib/xapsd/database.json"`
+		SQLite string `default:"/var/lib/xapsd/xapsd.db"`
+
+		ExpireAfter         string
+		ExpireCheckInterval string `default:"1h"`
+
+		CacheSize int
+		CacheTTL  string `default:"1m"`
+
+		HealthCheckInterval string `default:"30s"`
+		ReconnectMaxBackoff string `default:"1m"`
+
+		DuplicateTokens string `default:"keep"`
+
+		EncryptionKeyFile string
+	}
+
 	DB struct {
 		Host	 string
-		Port	 uint16 `default:"3306"`
+		Port	 uint16
 		Socket	 string
 		Name	 string
 		User	 string `default:"root"`
-		Password string `required:"true"`
-		Options  string `default:"timeout=5s&collation=utf8mb4_unicode_ci"`
+		Password string
+		Options  string
+		SSLMode  string
+		SearchPath string
+		Preset	 string
+		Replica	 string
 		Queries map[string]SQLQueries
 		ConnectionMaxLifeTime	string	`default:"0"`
 		MaxIdleConnections	int	`default:"2"`
@@ -171,15 +244,15 @@ func main() {
 	config := flag.String("config", "/etc/xapsd.toml", "path to configuration file")
 	socket := flag.String("socket", "", "path to the socket for Dovecot")
 	printsocket := flag.Bool("printsocket", false, "only print current socket file and exit")
-	certfile := flag.String("certificate", "", "path to the pem/p12 file containing the key and certificate")
 	flag.Parse()
 
-	_, err := os.Stat(*config)
-	if err != nil {
-		log.Fatal("Config file does not exist ", *config)
+	if flag.NArg() > 0 {
+		os.Exit(runSubcommand(*config, flag.Args()))
 	}
 
-	configor.Load(&Config, *config)
+	if err := loadConfig(*config); err != nil {
+		log.Fatal(err)
+	}
 
 	if *certfile != "" {
 		Config.Certificate = *certfile
@@ -194,15 +267,20 @@ func main() {
 		os.Exit(0)
 	}
 
-	db, err := connectDatabase()
+	if err := checkLimits(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPatterns(); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openStore()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.conn.Close()
+	defer db.close()
 
-	for _, sql := range db.queries {
-		defer sql.Close()
-        }
+	expireRegistrations(db)
 
 	// Delete the socket if it already exists
 	if _, err := os.Stat(Config.Socket); err == nil {
@@ -226,33 +304,13 @@ func main() {
 		log.Fatal("Could not chmod socket: ", err.Error())
 	}
 
-	if *debug {
-		log.Println("[DEBUG] Parsing", Config.Certificate, "to obtain APNS Topic")
-	}
-
-        cert, err := certificate.FromPemFile(Config.Certificate, "")
-        if err != nil {
-		log.Println("PEM Certificate Loading Error: ", err)
-		cert, err = certificate.FromP12File(Config.Certificate, "")
-		if err != nil { 
-			log.Fatal("P12 Certificate Loading Error: ", err)
-		}
-	}
-
-	topic, err := topicFromCertificate(cert.Leaf)
+	identities, err := loadIdentities()
 	if err != nil {
-		log.Fatal("Could not parse apns topic from certificate: ", err.Error())
-	}
-
-	if *debug {
-		log.Println("[DEBUG] Topic is", topic)
-	}
-
-	if *debug {
-		log.Println("[DEBUG] Creating APNS client to", apns2.HostProduction)
+		log.Fatal(err)
 	}
 
-	c := apns2.NewClient(cert).Production()
+	monitorCertificateExpiry(identities)
+	watchCertificates(identities)
 
 	signalChannel := make(chan os.Signal, 2)
 	quit := make(chan bool)
@@ -284,13 +342,13 @@ func main() {
 			log.Println("[DEBUG] Accepted a connection")
 		}
 
-		go handleRequest(conn, c, db, topic)
+		go handleRequest(conn, identities, db)
 
 
 	}
 }
 
-func handleRequest(conn net.Conn, client *apns2.Client, db *Database, topic string) {
+func handleRequest(conn net.Conn, identities *pushIdentities, db registrationStore) {
 	defer conn.Close()
 
 	scanner := bufio.NewScanner(conn)
@@ -306,9 +364,11 @@ func handleRequest(conn net.Conn, client *apns2.Client, db *Database, topic stri
 
 		switch command.name {
 		case "REGISTER":
-			handleRegister(conn, command, client, db, topic)
+			handleRegister(conn, command, identities, db)
 		case "NOTIFY":
-			handleNotify(conn, command, client, db)
+			handleNotify(conn, command, identities, db)
+		case "STATUS":
+			handleStatus(conn, identities, db)
 		default:
 			writeError(conn, "Unknown command")
 		}
@@ -328,19 +388,20 @@ func handleRequest(conn net.Conn, client *apns2.Client, db *Database, topic stri
 //     dovecot-mailboxes=("Inbox","Notes")
 //
 // The command returns the aps-topic, which is the common name of
-// the certificate issued by OS X Server for email push
-// notifications.
+// the certificate issued by OS X Server for the push identity that
+// handles the aps-subtopic.
 //
 
-func handleRegister(conn net.Conn, cmd command, client *apns2.Client, db *Database, topic string) {
+func handleRegister(conn net.Conn, cmd command, identities *pushIdentities, db registrationStore) {
 	// Make sure the subtopic is ok
 	subtopic, ok := cmd.getStringArg("aps-subtopic")
 	if !ok {
 		writeError(conn, "Missing apis-subtopic argument")
 		return
 	}
-	if subtopic != "com.apple.mobilemail" {
-		writeError(conn, "Unknown aps-subtopic")
+	identity, err := identities.forSubtopic(subtopic)
+	if err != nil {
+		writeError(conn, err.Error())
 		return
 	}
 
@@ -366,14 +427,28 @@ func handleRegister(conn net.Conn, cmd command, client *apns2.Client, db *Databa
 		return
 	}
 
+	if len(mailboxes) == 0 {
+		mailboxes = Config.Mailboxes.Default
+	}
+	if Config.Mailboxes.Patterns {
+		if err := checkMailboxPatterns(mailboxes); err != nil {
+			writeError(conn, "Failed to register client: "+err.Error())
+			return
+		}
+	}
+
 	// Register this email/account-id/device-token combination
-	err := db.addRegistration(username, accountId, deviceToken, mailboxes)
-	if err != nil {
+	err = db.addRegistration(username, accountId, deviceToken, subtopic, mailboxes)
+	if isLimitError(err) {
 		writeError(conn, "Failed to register client: "+err.Error())
 		return
 	}
+	if err != nil {
+		writeStoreError(conn, "Failed to register client: ", err)
+		return
+	}
 
-	writeSuccess(conn, topic)
+	writeSuccess(conn, identity.topic)
 }
 
 //
@@ -383,14 +458,15 @@ func handleRegister(conn net.Conn, cmd command, client *apns2.Client, db *Databa
 //
 // See if the the username has devices registered. If it has, loop
 // over them to find the ones that are interested in the named
-// mailbox and send those a push notificiation.
+// mailbox and send those a push notificiation using the identity
+// they registered with.
 //
 // The push notification looks like this:
 //
 //  { "aps": { "account-id": aps-account-id } }
 //
 
-func handleNotify(conn net.Conn, cmd command, client *apns2.Client, db *Database) {
+func handleNotify(conn net.Conn, cmd command, identities *pushIdentities, db registrationStore) {
 	// Make sure we got the required arguments
 	username, ok := cmd.getStringArg("dovecot-username")
 	if !ok {
@@ -406,7 +482,7 @@ func handleNotify(conn net.Conn, cmd command, client *apns2.Client, db *Database
 	// Find all the devices registered for this mailbox event
 	registrations, err := db.findRegistrations(username, mailbox)
 	if err != nil {
-		writeError(conn, "Cannot lookup registrations: "+err.Error())
+		writeStoreError(conn, "Cannot lookup registrations: ", err)
 		return
 	}
 
@@ -417,23 +493,32 @@ func handleNotify(conn net.Conn, cmd command, client *apns2.Client, db *Database
 		if *debug {
 			log.Println("[DEBUG] Sending notification to", registration.AccountId, "/", registration.DeviceToken)
 		}
-		res := sendNotification(registration, client)
-		if res.StatusCode == 410 {
+		identity, err := identities.forSubtopic(registration.Subtopic)
+		if err != nil {
+			log.Printf("Cannot notify %v: no identity for subtopic %v\n", auditPrefix(registration.AccountId), registration.Subtopic)
+			continue
+		}
+		res := sendNotification(registration, identity)
+		if res != nil && res.StatusCode == 410 {
 			if *debug {
 				log.Printf("[DEBUG] Device %v (DB: %v) is no longer registered. APN-Status: %v (%v)\n", registration.AccountId, registration.DbId, res.StatusCode, res.Reason)
 			}
-			db.deleteRegistration(registration)
+			if err := db.deleteRegistration(registration); err == nil {
+				recordAudit(auditRemoved, registration, fmt.Sprintf("APNs %d %s", res.StatusCode, res.Reason))
+			}
 		}
 	}
 
 	writeSuccess(conn, "")
 }
 
-func sendNotification(reg Registration, client *apns2.Client) (*apns2.Response) {
+func sendNotification(reg Registration, identity *pushIdentity) (*apns2.Response) {
 	notification := &apns2.Notification{}
 	notification.Payload = SetAccountID(reg.AccountId)
 	notification.DeviceToken = reg.DeviceToken
+	notification.Topic = identity.topic
 	notification.Expiration = time.Now().Add(24 * time.Hour)
+	client, _ := identity.current()
 	res, err := client.Push(notification)
 
 	if err != nil {
@@ -454,6 +539,18 @@ func writeError(conn net.Conn, msg string) {
 	conn.Write([]byte("ERROR" + " " + msg + "\n"))
 }
 
+//
+// Errors because the storage is unavailable start with [UNAVAILABLE],
+// so that clients know that they can try again later.
+//
+
+func writeStoreError(conn net.Conn, msg string, err error) {
+	if isUnavailable(err) {
+		msg = "[UNAVAILABLE] " + msg
+	}
+	writeError(conn, msg+err.Error())
+}
+
 func writeSuccess(conn net.Conn, msg string) {
 	if *debug {
 		log.Println("[DEBUG] Returning success:", msg)
@@ -81,3 +81,33 @@ func Test_ParseCommand_Notify(t *testing.T) {
 		t.Error(`val != "Inbox" ` + val)
 	}
 }
+
+func Test_ParseCommand_Status(t *testing.T) {
+	cmd, err := parseCommand("STATUS")
+	if err != nil {
+		t.Error("Cannot parseCommand", err)
+	}
+
+	if cmd.name != "STATUS" {
+		t.Error(`cmd.name != "STATUS"`)
+	}
+
+	if len(cmd.args) != 0 {
+		t.Error(`len(cmd.args) != 0`)
+	}
+
+	if _, err := parseCommand(""); err == nil {
+		t.Error(`parseCommand("") did not fail`)
+	}
+}
+
+func Test_ParseCommand_EmptyList(t *testing.T) {
+	cmd, err := parseCommand(`REGISTER dovecot-username="stefan"	dovecot-mailboxes=()`)
+	if err != nil {
+		t.Error("Cannot parseCommand", err)
+	}
+
+	if mailboxes, ok := cmd.getListArg("dovecot-mailboxes"); !ok || len(mailboxes) != 0 {
+		t.Error(`dovecot-mailboxes != []`, mailboxes)
+	}
+}